@@ -0,0 +1,252 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SetAckSecret sets the key ack tokens are derived from. Without one a random
+// key is used, and tokens sent before a restart stop working.
+func (s *Server) SetAckSecret(secret string) {
+	if secret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		secret = string(b)
+	}
+	s.ackSecret = []byte(secret)
+}
+
+func (s *Server) ackToken(delivery string) string {
+	h := hmac.New(sha256.New, s.ackSecret)
+	h.Write([]byte(delivery))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// ackInfo is added to hook payloads so receivers can acknowledge a delivery
+// or mark it read, by calling the URLs or /delivery/ack with the token.
+func (s *Server) ackInfo(delivery string) wsgo.H {
+	if delivery == "" {
+		return nil
+	}
+	token := s.ackToken(delivery)
+	r := wsgo.H{"delivery": delivery, "token": token}
+	if s.publicURL != "" {
+		u := s.publicURL + s.prefix + "/delivery/ack?" + url.Values{"delivery": {delivery}, "token": {token}}.Encode()
+		r["url"], r["read_url"] = u, u+"&read=true"
+	}
+	return r
+}
+
+type ackEscalation struct {
+	timeout time.Duration
+	session string
+	group   string
+}
+
+// parseAckEscalation reads the ack timeout of a push and where to escalate to.
+func (s *Server) parseAckEscalation(ps map[string]string) (ackEscalation, error) {
+	e := ackEscalation{session: ps["escalate_session"], group: ps["escalate_group"]}
+	v := ps["ack_timeout"]
+	if v == "" {
+		if e.session != "" || e.group != "" {
+			return e, fmt.Errorf("escalation needs ack_timeout")
+		}
+		return e, nil
+	}
+	var err error
+	if e.timeout, err = time.ParseDuration(v); err != nil {
+		return e, fmt.Errorf("invalid ack_timeout: %v", err)
+	}
+	if e.timeout <= 0 {
+		return e, fmt.Errorf("invalid ack_timeout: %v", v)
+	}
+	if e.session != "" && e.group != "" {
+		return e, fmt.Errorf("escalate to a session or a group, not both")
+	}
+	if e.session != "" {
+		_, err = s.db.GetSessionByID(e.session)
+	}
+	if e.group != "" {
+		_, err = s.db.GetGroupByID(e.group)
+	}
+	return e, err
+}
+
+// watchAck escalates m if the delivery has not been acknowledged timeout after
+// it was sent, which is t at the earliest. The escalation goes to the session
+// or group given, or back to the delivery session.
+func (s *Server) watchAck(delivery string, m *Message, t time.Time, timeout time.Duration, session string, group string) {
+	j := &AckTimeoutJob{delivery: delivery, message: m, timeout: timeout, session: session, group: group}
+	j.bind(s)
+	s.scheduler.AddJob(j, NewOneTimeSchedule(t.Add(timeout)))
+}
+
+// ackRecheck is how often a watch looks again at a delivery not sent yet.
+const ackRecheck = time.Minute
+
+// AckTimeoutJob re-sends an unacknowledged message with a raised priority.
+type AckTimeoutJob struct {
+	delivery string
+	message  *Message
+	timeout  time.Duration
+	session  string
+	group    string
+	srv      *Server
+}
+
+// deadline returns when the watch of d is over, or false if it ends without
+// escalating. Quiet hours, digests and retries delay the send past the push,
+// and the deadline only counts from the send.
+func (j *AckTimeoutJob) deadline(d database.Delivery, now time.Time) (time.Time, bool) {
+	switch d.GetStatus() {
+	case DeliveryDelivered:
+		return d.GetUpdated().Add(j.timeout), true
+	case DeliveryScheduled, DeliveryDeferred:
+		// the detail is when the delivery is due
+		if t, err := time.Parse(time.RFC3339, d.GetDetail()); err == nil && t.After(now) {
+			return t.Add(j.timeout), true
+		}
+		return now.Add(ackRecheck), true
+	case DeliveryPending, DeliveryBatched, DeliveryRetrying:
+		return now.Add(ackRecheck), true
+	case DeliveryExpired, DeliveryDropped:
+		return time.Time{}, false
+	}
+	// failed deliveries escalate right away
+	return now, true
+}
+
+func (j *AckTimeoutJob) bind(s *Server) {
+	j.srv = s
+}
+
+func (j *AckTimeoutJob) Run() {
+	if j.srv == nil || j.message == nil {
+		return
+	}
+	d, err := j.srv.db.GetDeliveryByID(j.delivery)
+	if err != nil {
+		fmt.Printf("ack timeout: %v\n", err)
+		return
+	}
+	if !d.GetAckedAt().IsZero() {
+		return
+	}
+	// watches saved without a timeout escalate when they fire
+	if now := time.Now(); j.timeout > 0 {
+		t, ok := j.deadline(d, now)
+		if !ok {
+			return
+		}
+		if t.After(now) {
+			next := *j
+			j.srv.scheduler.AddJob(&next, NewOneTimeSchedule(t))
+			return
+		}
+	}
+	m := *j.message
+	m.Priority = m.Priority.raised()
+	m.Title = "Unacknowledged: " + m.Title
+	if j.group != "" {
+		g, err := j.srv.db.GetGroupByID(j.group)
+		if err == nil {
+			_, err = Group{g}.Push(&m, j.srv)
+		}
+		if err != nil {
+			fmt.Printf("ack timeout %v: escalate to group %v: %v\n", j.delivery, j.group, err)
+		}
+		return
+	}
+	sid := j.session
+	if sid == "" {
+		sid = d.GetSessionID()
+	}
+	session, err := j.srv.db.GetSessionByID(sid)
+	if err != nil {
+		fmt.Printf("ack timeout %v: escalate to session %v: %v\n", j.delivery, sid, err)
+		return
+	}
+	if r := (Session{session}).Push(&m, j.srv); r.Err != nil && !accepted(r.Err) {
+		fmt.Printf("ack timeout %v: escalate to session %v: %v\n", j.delivery, sid, r.Err)
+	}
+}
+
+func (j *AckTimeoutJob) Save() (bson.M, error) {
+	b, err := json.Marshal(j.message)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"delivery": j.delivery, "message": string(b), "timeout": j.timeout.String(), "session": j.session,
+		"group": j.group}, nil
+}
+
+func (j *AckTimeoutJob) Load(m bson.M) error {
+	delivery, ok := m["delivery"].(string)
+	if !ok {
+		return fmt.Errorf("missing delivery")
+	}
+	s, ok := m["message"].(string)
+	if !ok {
+		return fmt.Errorf("missing message")
+	}
+	if err := json.Unmarshal([]byte(s), &j.message); err != nil {
+		return err
+	}
+	j.delivery = delivery
+	if t, ok := m["timeout"].(string); ok {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		j.timeout = d
+	}
+	j.session, _ = m["session"].(string)
+	j.group, _ = m["group"].(string)
+	return nil
+}
+
+func (j *AckTimeoutJob) GetType() string {
+	return "AckTimeoutJob"
+}
+
+func (j *AckTimeoutJob) IsType(t string) bool {
+	return t == "AckTimeoutJob"
+}
+
+func (s *Server) handleAcks(r *wsgo.ServerMux) {
+	// acknowledge a delivery, or with read only mark it read; also the target of the ack urls
+	// delivery={deliveryid}&token={}&read={bool}
+	r.Handle(s.prefix+"/delivery/ack", func(c *wsgo.Context) {
+		form := formParams(c)
+		did, token := firstValue(c, form, "delivery"), firstValue(c, form, "token")
+		d, err := s.db.GetDeliveryByID(did)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if !hmac.Equal([]byte(token), []byte(s.ackToken(did))) {
+			c.String(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			c.Log("delivery %v ack: invalid token", did)
+			return
+		}
+		read := firstValue(c, form, "read")
+		if err := d.Ack(time.Now(), read == "true" || read == "1"); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("delivery %v ack: %v", did, err)
+			return
+		}
+		c.Json(http.StatusOK, Delivery{d}.WsgoH())
+	})
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+)
+
+// stubDelivery is a delivery with only what ack watches read.
+type stubDelivery struct {
+	database.Delivery
+	status  string
+	detail  string
+	updated time.Time
+}
+
+func (d stubDelivery) GetStatus() string     { return d.status }
+func (d stubDelivery) GetDetail() string     { return d.detail }
+func (d stubDelivery) GetUpdated() time.Time { return d.updated }
+
+func TestAckDeadline(t *testing.T) {
+	now := time.Date(2026, 3, 1, 22, 0, 0, 0, time.UTC)
+	quietEnd := now.Add(9 * time.Hour)
+	j := &AckTimeoutJob{timeout: 15 * time.Minute}
+	tests := []struct {
+		name string
+		d    stubDelivery
+		want time.Time
+		ok   bool
+	}{
+		{"delivered", stubDelivery{status: DeliveryDelivered, updated: now.Add(-5 * time.Minute)}, now.Add(10 * time.Minute), true},
+		{"deferred by quiet hours", stubDelivery{status: DeliveryDeferred, detail: quietEnd.Format(time.RFC3339)}, quietEnd.Add(15 * time.Minute), true},
+		{"deferred and due", stubDelivery{status: DeliveryDeferred, detail: now.Format(time.RFC3339)}, now.Add(ackRecheck), true},
+		{"batched", stubDelivery{status: DeliveryBatched}, now.Add(ackRecheck), true},
+		{"retrying", stubDelivery{status: DeliveryRetrying}, now.Add(ackRecheck), true},
+		{"failed", stubDelivery{status: DeliveryFailed}, now, true},
+		{"dropped", stubDelivery{status: DeliveryDropped}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := j.deadline(tt.d, now)
+		if !got.Equal(tt.want) || ok != tt.ok {
+			t.Errorf("%v: deadline = %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
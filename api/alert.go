@@ -0,0 +1,216 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// alert is one alert of an Alertmanager or Grafana webhook. Both send the
+// same shape; Grafana adds a few URLs and the evaluated values.
+type alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	ValueString  string            `json:"valueString"`
+	DashboardURL string            `json:"dashboardURL"`
+	PanelURL     string            `json:"panelURL"`
+	SilenceURL   string            `json:"silenceURL"`
+}
+
+type alertPayload struct {
+	Receiver string  `json:"receiver"`
+	Status   string  `json:"status"`
+	Alerts   []alert `json:"alerts"`
+
+	// legacy Grafana alerting
+	RuleName string `json:"ruleName"`
+	RuleURL  string `json:"ruleUrl"`
+	State    string `json:"state"`
+	Message  string `json:"message"`
+}
+
+// legacyAlerts converts a payload of the old Grafana alerting into alerts.
+func (p alertPayload) legacyAlerts() []alert {
+	if len(p.Alerts) > 0 || p.RuleName == "" {
+		return p.Alerts
+	}
+	status := "firing"
+	if p.State == "ok" {
+		status = "resolved"
+	}
+	return []alert{{
+		Status:       status,
+		Labels:       map[string]string{"alertname": p.RuleName},
+		Annotations:  map[string]string{"description": p.Message},
+		GeneratorURL: p.RuleURL,
+	}}
+}
+
+// alertPriority maps the severity label.
+func alertPriority(a alert) Priority {
+	if a.Status == "resolved" {
+		return PriorityNormal
+	}
+	switch strings.ToLower(a.Labels["severity"]) {
+	case "critical", "page", "emergency", "fatal":
+		return PriorityCritical
+	case "error", "high", "major", "warning":
+		return PriorityHigh
+	case "info", "low", "minor", "none":
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+func alertLines(a alert) []string {
+	var l []string
+	for _, k := range []string{"summary", "description", "message"} {
+		if v := a.Annotations[k]; v != "" {
+			l = append(l, v)
+		}
+	}
+	if a.ValueString != "" {
+		l = append(l, "Value: "+a.ValueString)
+	}
+	var ls []string
+	for k, v := range a.Labels {
+		if k != "alertname" {
+			ls = append(ls, k+"="+v)
+		}
+	}
+	sort.Strings(ls)
+	if len(ls) > 0 {
+		l = append(l, "Labels: "+strings.Join(ls, ", "))
+	}
+	if !a.StartsAt.IsZero() {
+		l = append(l, "Since: "+a.StartsAt.Format(time.RFC3339))
+	}
+	for _, u := range []string{a.GeneratorURL, a.DashboardURL, a.PanelURL} {
+		if u != "" {
+			l = append(l, u)
+			break
+		}
+	}
+	return l
+}
+
+// alertMessages groups alerts by status and the values of the groupBy labels,
+// making one message per group. The title comes from the alertname, the
+// content from the annotations, and the most severe alert sets the priority.
+func alertMessages(alerts []alert, groupBy []string, author string) []*Message {
+	type alertGroup struct {
+		status string
+		values []string
+		alerts []alert
+	}
+	var order []string
+	groups := map[string]*alertGroup{}
+	for _, a := range alerts {
+		if a.Status == "" {
+			a.Status = "firing"
+		}
+		values := make([]string, len(groupBy))
+		for i, l := range groupBy {
+			values[i] = a.Labels[l]
+		}
+		key := a.Status + "\x00" + strings.Join(values, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &alertGroup{status: a.Status, values: values}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.alerts = append(g.alerts, a)
+	}
+	var ms []*Message
+	for _, key := range order {
+		g := groups[key]
+		names := []string{}
+		seen := map[string]bool{}
+		m := &Message{Author: author, Priority: PriorityLow}
+		var parts []string
+		for _, a := range g.alerts {
+			if n := a.Labels["alertname"]; n != "" && !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+			if p := alertPriority(a); p.Level() > m.Priority.Level() {
+				m.Priority = p
+			}
+			parts = append(parts, strings.Join(alertLines(a), "\n"))
+		}
+		var extra []string
+		for i, l := range groupBy {
+			if l != "alertname" && g.values[i] != "" {
+				extra = append(extra, g.values[i])
+			}
+		}
+		title := fmt.Sprintf("[%s:%d] %s", strings.ToUpper(g.status), len(g.alerts), strings.Join(names, ", "))
+		if len(extra) > 0 {
+			title += " (" + strings.Join(extra, " ") + ")"
+		}
+		m.Title = strings.TrimSpace(title)
+		m.Content = strings.Join(parts, "\n\n")
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// handleAlerts registers the Alertmanager and Grafana webhook receivers. The
+// alias key is the last path segment; group_by lists the labels alerts are
+// grouped by and defaults to alertname.
+func (s *Server) handleAlerts(r *wsgo.ServerMux) {
+	for _, kind := range []string{AliasAlertmanager, AliasGrafana} {
+		kind := kind
+		// POST /{alertmanager|grafana}/{key}?group_by={label,...}
+		r.POST(s.prefix+"/"+kind+"/*", func(c *wsgo.Context) {
+			req := c.GetRequest()
+			key := strings.TrimPrefix(req.URL.Path, s.prefix+"/"+kind+"/")
+			a, err := s.db.GetAlias(kind, key)
+			if err != nil {
+				c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+				c.Log("%v webhook %q: %v", kind, key, err)
+				return
+			}
+			if t := a.GetToken(); t != "" && requestToken(req) != t {
+				c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+				c.Log("Unauthorized: %v webhook %q", kind, key)
+				return
+			}
+			var p alertPayload
+			if err := c.BindJSON(&p); err != nil {
+				c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+				c.Log("Bad Request: %v", err)
+				return
+			}
+			groupBy := []string{"alertname"}
+			if v, ok := c.Query("group_by"); ok && v != "" {
+				groupBy = strings.Split(v, ",")
+			}
+			author := p.Receiver
+			if author == "" {
+				author = kind
+			}
+			deliveries := []string{}
+			for _, m := range alertMessages(p.legacyAlerts(), groupBy, author) {
+				d, err := s.pushAlias(c, a, m)
+				if err != nil {
+					c.Log("push %v alert %q: %v", kind, m.Title, err)
+					continue
+				}
+				if d != "" {
+					deliveries = append(deliveries, d)
+				}
+			}
+			c.Json(http.StatusOK, wsgo.H{"deliveries": deliveries})
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// ErrCircuitOpen is returned for pushes to a session whose circuit breaker is
+// open; the delivery is queued or dropped depending on the breaker mode.
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	BreakerQueue = "queue"
+	BreakerDrop  = "drop"
+)
+
+// Breaker configures the circuit breaker of session hooks. After Threshold
+// consecutive failed deliveries the circuit opens and deliveries are queued
+// until it closes (BreakerQueue) or dropped (BreakerDrop). The hook is probed
+// every ProbeInterval and the first success closes the circuit. Sessions
+// failing for HideAfter are hidden until they recover. A zero Threshold
+// disables the breaker, a zero HideAfter the hiding.
+type Breaker struct {
+	Threshold     int
+	Mode          string
+	ProbeInterval time.Duration
+	HideAfter     time.Duration
+}
+
+func DefaultBreaker() Breaker {
+	return Breaker{Threshold: 5, Mode: BreakerQueue, ProbeInterval: 5 * time.Minute, HideAfter: 72 * time.Hour}
+}
+
+// probeTick is how often sessions are checked for due probes.
+const probeTick = time.Minute
+
+func (s *Server) SetBreaker(b Breaker) error {
+	if b.Mode != BreakerQueue && b.Mode != BreakerDrop {
+		return fmt.Errorf("unknown breaker mode: %s", b.Mode)
+	}
+	if b.ProbeInterval < probeTick {
+		b.ProbeInterval = probeTick
+	}
+	s.breaker = b
+	return nil
+}
+
+// circuitOpen tells if deliveries to the session are held back, and if so
+// when to try again.
+func (s *Server) circuitOpen(session database.Session) (time.Time, bool) {
+	h := session.GetHealth()
+	if h.Opened.IsZero() {
+		return time.Time{}, false
+	}
+	at := h.NextProbe
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	return at.Add(probeTick), true
+}
+
+// recordSuccess closes the circuit of the session, unhiding it if it was
+// hidden for failing.
+func (s *Server) recordSuccess(session database.Session) {
+	h := session.GetHealth()
+	if err := session.RecordSuccess(time.Now()); err != nil {
+		fmt.Printf("health: %v\n", err)
+		return
+	}
+	if !h.Opened.IsZero() {
+		fmt.Printf("health: session %v recovered after %d failures\n", session.GetID(), h.Failures)
+	}
+	if h.AutoHidden {
+		if err := session.Unhide(); err != nil {
+			fmt.Printf("health: %v\n", err)
+		}
+	}
+}
+
+// recordFailure counts a failed delivery, opening the circuit at the threshold.
+func (s *Server) recordFailure(session database.Session, detail string) {
+	now := time.Now()
+	h, err := session.RecordFailure(now, detail)
+	if err != nil {
+		fmt.Printf("health: %v\n", err)
+		return
+	}
+	if s.breaker.Threshold <= 0 || h.Failures < s.breaker.Threshold || !h.Opened.IsZero() {
+		return
+	}
+	h.Opened, h.NextProbe = now, now.Add(s.breaker.ProbeInterval)
+	if err := session.SetHealth(h); err != nil {
+		fmt.Printf("health: %v\n", err)
+		return
+	}
+	fmt.Printf("health: session %v circuit opened after %d failures: %v\n", session.GetID(), h.Failures, detail)
+}
+
+// probe checks the hook of a session with an open circuit, closing it on
+// success and hiding the session when it has been failing for too long.
+func (s *Server) probe(session database.Session) {
+	h := session.GetHealth()
+	m := &Message{Author: "tbcpusher", Title: "Hook check", Priority: PriorityLow,
+		Content: fmt.Sprintf("Deliveries to session %v have been failing since %v; this checks the hook again.",
+			session.GetID(), h.Opened.Format(time.RFC3339))}
+	err := s.notify(session, session.GetPushHook(), m)
+	if err == nil {
+		s.recordSuccess(session)
+		return
+	}
+	now := time.Now()
+	if h, err = session.RecordFailure(now, err.Error()); err != nil {
+		fmt.Printf("health: %v\n", err)
+		return
+	}
+	h.NextProbe = now.Add(s.breaker.ProbeInterval)
+	if s.breaker.HideAfter > 0 && now.Sub(h.Opened) >= s.breaker.HideAfter && !session.IsHidden() {
+		if err := session.Hide(); err != nil {
+			fmt.Printf("health: %v\n", err)
+		} else {
+			h.AutoHidden = true
+			fmt.Printf("health: session %v hidden after failing since %v\n", session.GetID(), h.Opened)
+		}
+	}
+	if err := session.SetHealth(h); err != nil {
+		fmt.Printf("health: %v\n", err)
+	}
+}
+
+func (s *Server) probeLoop() {
+	for {
+		sessions, err := s.db.GetProbeDue(time.Now())
+		if err != nil {
+			fmt.Printf("health: %v\n", err)
+		}
+		for _, session := range sessions {
+			s.probe(session)
+		}
+		time.Sleep(probeTick)
+	}
+}
+
+func healthWsgoH(h database.Health) wsgo.H {
+	state := "closed"
+	if !h.Opened.IsZero() {
+		state = "open"
+	}
+	r := wsgo.H{"state": state, "failures": h.Failures, "lastError": h.LastError, "autoHidden": h.AutoHidden}
+	for k, t := range map[string]time.Time{"lastFailure": h.LastFailure, "lastSuccess": h.LastSuccess,
+		"opened": h.Opened, "nextProbe": h.NextProbe} {
+		if !t.IsZero() {
+			r[k] = t
+		}
+	}
+	return r
+}
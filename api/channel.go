@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	ChannelGeneric  = "generic"
+	ChannelSlack    = "slack"
+	ChannelDiscord  = "discord"
+	ChannelTeams    = "teams"
+	ChannelTelegram = "telegram"
+)
+
+// Channel renders payloads for one kind of receiver and recognizes its rate
+// limit responses. A payload holds "session" and either a single "message"
+// or the "messages" of a digest.
+type Channel interface {
+	Request(s Session, payload wsgo.H) (request, error)
+	RateLimited(resp *http.Response, body []byte) (time.Duration, bool)
+}
+
+func defaultChannels() map[string]Channel {
+	return map[string]Channel{
+		ChannelGeneric:  genericChannel{},
+		ChannelSlack:    slackChannel{},
+		ChannelDiscord:  discordChannel{},
+		ChannelTeams:    teamsChannel{},
+		ChannelTelegram: telegramChannel{apiBase: defaultTelegramAPI},
+		ChannelEmail:    emailChannel{},
+	}
+}
+
+func (s *Server) checkChannel(name string) error {
+	if name == "" {
+		return nil
+	}
+	c, ok := s.channels[name]
+	if !ok {
+		return fmt.Errorf("unknown channel: %s", name)
+	}
+	if e, ok := c.(emailChannel); ok && e.cfg.Host == "" {
+		return fmt.Errorf("channel %s: smtp is not configured", name)
+	}
+	return nil
+}
+
+func (s *Server) channel(name string) Channel {
+	if c, ok := s.channels[name]; ok {
+		return c
+	}
+	return genericChannel{}
+}
+
+// request encodes payload for the session's channel.
+func (s Session) request(srv *Server, payload wsgo.H) (request, error) {
+	name := s.GetChannel()
+	r, err := srv.channel(name).Request(s, payload)
+	r.Session, r.Channel = s.GetID(), name
+	return r, err
+}
+
+// payloadMessages returns the messages carried by a payload.
+func payloadMessages(payload wsgo.H) []*Message {
+	if m, ok := payload["message"].(*Message); ok {
+		return []*Message{m}
+	}
+	ms, _ := payload["messages"].([]*Message)
+	return ms
+}
+
+// payloadAck returns the URLs acknowledging or marking read the delivery of a
+// payload, empty if it has none or the server has no public URL.
+func payloadAck(payload wsgo.H) (string, string) {
+	ack, _ := payload["ack"].(wsgo.H)
+	u, _ := ack["url"].(string)
+	read, _ := ack["read_url"].(string)
+	return u, read
+}
+
+func jsonRequest(s Session, v any) (request, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return request{}, err
+	}
+	return request{
+		Method: http.MethodPost,
+		URL:    s.GetPushHook(),
+		Header: map[string]string{"Content-Type": "application/json"},
+		Body:   b,
+	}, nil
+}
+
+// retryAfterHeader reads a Retry-After header in seconds or as an HTTP date.
+func retryAfterHeader(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(sec * float64(time.Second)), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// rateLimitedStatus handles the common 429 and 503 responses.
+func rateLimitedStatus(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	if d, ok := retryAfterHeader(resp); ok {
+		return d, true
+	}
+	return 0, resp.StatusCode == http.StatusTooManyRequests
+}
+
+// genericChannel sends the payload in the session's format.
+type genericChannel struct{}
+
+func (genericChannel) Request(s Session, payload wsgo.H) (request, error) {
+	return s.formatRequest(payload)
+}
+
+func (genericChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	return rateLimitedStatus(resp)
+}
+
+// slackChannel posts Block Kit messages to Slack incoming webhooks.
+type slackChannel struct{}
+
+func (slackChannel) Request(s Session, payload wsgo.H) (request, error) {
+	var blocks []wsgo.H
+	var text []string
+	for i, m := range payloadMessages(payload) {
+		if i > 0 {
+			blocks = append(blocks, wsgo.H{"type": "divider"})
+		}
+		if m.Title != "" {
+			blocks = append(blocks, wsgo.H{"type": "header", "text": wsgo.H{"type": "plain_text", "text": truncate(m.Title, 150)}})
+		}
+		if m.Content != "" {
+			blocks = append(blocks, wsgo.H{"type": "section", "text": wsgo.H{"type": "mrkdwn", "text": truncate(m.Content, 3000)}})
+		}
+		context := []wsgo.H{{"type": "mrkdwn", "text": "priority: " + string(m.Priority)}}
+		if m.Author != "" {
+			context = append([]wsgo.H{{"type": "plain_text", "text": truncate(m.Author, 150)}}, context...)
+		}
+		blocks = append(blocks, wsgo.H{"type": "context", "elements": context})
+		text = append(text, strings.TrimSpace(m.Title+" "+m.Content))
+	}
+	if u, read := payloadAck(payload); u != "" {
+		blocks = append(blocks, wsgo.H{"type": "actions", "elements": []wsgo.H{
+			{"type": "button", "text": wsgo.H{"type": "plain_text", "text": "Acknowledge"}, "url": u, "style": "primary"},
+			{"type": "button", "text": wsgo.H{"type": "plain_text", "text": "Mark read"}, "url": read},
+		}})
+	}
+	if len(blocks) > 50 {
+		blocks = blocks[:50]
+	}
+	return jsonRequest(s, wsgo.H{"text": truncate(strings.Join(text, "\n"), 3000), "blocks": blocks})
+}
+
+func (slackChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	return rateLimitedStatus(resp)
+}
+
+// discordChannel posts embeds to Discord webhooks.
+type discordChannel struct{}
+
+// discordTotal is how many characters the embeds of a message may hold together.
+const discordTotal = 6000
+
+var discordColors = map[Priority]int{
+	PriorityLow:      0x95a5a6,
+	PriorityNormal:   0x3498db,
+	PriorityHigh:     0xe67e22,
+	PriorityCritical: 0xe74c3c,
+}
+
+func (discordChannel) Request(s Session, payload wsgo.H) (request, error) {
+	var embeds []wsgo.H
+	body := wsgo.H{}
+	left := discordTotal
+	// fit cuts s to the limit of its field and to what the total has left
+	fit := func(s string, n int) string {
+		if n > left {
+			n = left
+		}
+		if n <= 0 {
+			return ""
+		}
+		s = truncate(s, n)
+		left -= utf8.RuneCountInString(s)
+		return s
+	}
+	for _, m := range payloadMessages(payload) {
+		if len(embeds) == 10 || left <= 0 {
+			break
+		}
+		e := wsgo.H{"color": discordColors[m.Priority], "footer": wsgo.H{"text": fit(string(m.Priority), 2048)}}
+		if t := fit(m.Title, 256); t != "" {
+			e["title"] = t
+		}
+		if a := fit(m.Author, 256); a != "" {
+			e["author"] = wsgo.H{"name": a}
+		}
+		if d := fit(m.Content, 4096); d != "" {
+			e["description"] = d
+		}
+		embeds = append(embeds, e)
+	}
+	body["embeds"] = embeds
+	// webhooks cannot send buttons, so the ack links go in the content
+	if u, read := payloadAck(payload); u != "" {
+		body["content"] = "[Acknowledge](" + u + ") · [Mark read](" + read + ")"
+	}
+	return jsonRequest(s, body)
+}
+
+func (discordChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return rateLimitedStatus(resp)
+	}
+	var r struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if json.Unmarshal(body, &r) == nil && r.RetryAfter > 0 {
+		return time.Duration(r.RetryAfter * float64(time.Second)), true
+	}
+	return rateLimitedStatus(resp)
+}
+
+// teamsChannel posts Adaptive Cards to Microsoft Teams incoming webhooks.
+type teamsChannel struct{}
+
+func (teamsChannel) Request(s Session, payload wsgo.H) (request, error) {
+	var items []wsgo.H
+	for i, m := range payloadMessages(payload) {
+		title := wsgo.H{"type": "TextBlock", "text": m.Title, "weight": "Bolder", "size": "Medium", "wrap": true}
+		if i > 0 {
+			title["separator"] = true
+		}
+		if m.Priority == PriorityCritical || m.Priority == PriorityHigh {
+			title["color"] = "Attention"
+		}
+		if m.Title != "" {
+			items = append(items, title)
+		}
+		if m.Content != "" {
+			items = append(items, wsgo.H{"type": "TextBlock", "text": m.Content, "wrap": true})
+		}
+		if m.Author != "" {
+			items = append(items, wsgo.H{"type": "TextBlock", "text": m.Author, "isSubtle": true, "spacing": "None", "wrap": true})
+		}
+	}
+	card := wsgo.H{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    items,
+	}
+	if u, read := payloadAck(payload); u != "" {
+		card["actions"] = []wsgo.H{
+			{"type": "Action.OpenUrl", "title": "Acknowledge", "url": u},
+			{"type": "Action.OpenUrl", "title": "Mark read", "url": read},
+		}
+	}
+	return jsonRequest(s, wsgo.H{
+		"type":        "message",
+		"attachments": []wsgo.H{{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}},
+	})
+}
+
+// RateLimited also catches the old connectors, which answer 200 and report
+// the throttling in the body.
+func (teamsChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	if d, ok := rateLimitedStatus(resp); ok {
+		return d, true
+	}
+	if strings.Contains(string(body), "HTTP error 429") {
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,361 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/scheduler"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// stubSession is a session with only what channels read.
+type stubSession struct {
+	database.Session
+	hook string
+	data any
+}
+
+func (s stubSession) GetID() string       { return "stub" }
+func (s stubSession) GetPushHook() string { return s.hook }
+func (s stubSession) GetData() any        { return s.data }
+
+// memEntry and memEntries keep scheduler entries in memory.
+type memEntry struct {
+	job      scheduler.Job
+	schedule scheduler.Schedule
+	next     time.Time
+}
+
+func (e *memEntry) Schedule() scheduler.Schedule { return e.schedule }
+func (e *memEntry) Next() time.Time              { return e.next }
+func (e *memEntry) SetNext(t time.Time)          { e.next = t }
+func (e *memEntry) Job() scheduler.Job           { return e.job }
+
+type memEntries struct {
+	entries []scheduler.Entry
+}
+
+func (l *memEntries) NewEntry(j scheduler.Job, s scheduler.Schedule) scheduler.Entry {
+	return &memEntry{job: j, schedule: s}
+}
+func (l *memEntries) Len() int                 { return len(l.entries) }
+func (l *memEntries) All() []scheduler.Entry   { return l.entries }
+func (l *memEntries) Add(e scheduler.Entry)    { l.entries = append(l.entries, e) }
+func (l *memEntries) Remove(e scheduler.Entry) {}
+
+// testServer returns a server with an in-memory, stopped scheduler and a
+// client allowed to reach local stub servers.
+func testServer() (*Server, *memEntries) {
+	entries := &memEntries{}
+	sc := scheduler.NewDefult()
+	sc.SetEntries(entries)
+	return &Server{scheduler: sc, channels: defaultChannels(), client: &http.Client{}, breaker: DefaultBreaker()}, entries
+}
+
+// stubReceiver records the requests it gets and answers with respond.
+type stubReceiver struct {
+	*httptest.Server
+	paths  []string
+	bodies [][]byte
+}
+
+func newStubReceiver(t *testing.T, respond func(w http.ResponseWriter)) *stubReceiver {
+	r := &stubReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		r.paths, r.bodies = append(r.paths, req.URL.Path), append(r.bodies, b)
+		respond(w)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func ok(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// post renders payload for the channel and sends it to the receiver.
+func post(t *testing.T, ch Channel, s Session, payload wsgo.H) (*http.Response, []byte) {
+	t.Helper()
+	req, err := ch.Request(s, payload)
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	resp, body, err := req.do(&http.Client{})
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	return resp, body
+}
+
+func decode(t *testing.T, b []byte) map[string]any {
+	t.Helper()
+	var v map[string]any
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("invalid json %s: %v", b, err)
+	}
+	return v
+}
+
+func digest(ms ...*Message) wsgo.H {
+	return wsgo.H{"digest": true, "messages": ms}
+}
+
+func TestSlackRequest(t *testing.T) {
+	rcv := newStubReceiver(t, ok)
+	s := Session{stubSession{hook: rcv.URL + "/services/T/B/X"}}
+	post(t, slackChannel{}, s, digest(
+		&Message{Title: "Disk full", Content: "*db1* at 99%", Author: "monitor", Priority: PriorityHigh},
+		&Message{Title: strings.Repeat("t", 200), Priority: PriorityLow},
+	))
+	if rcv.paths[0] != "/services/T/B/X" {
+		t.Errorf("path = %v", rcv.paths[0])
+	}
+	v := decode(t, rcv.bodies[0])
+	if v["text"] != "Disk full *db1* at 99%\n"+strings.Repeat("t", 200) {
+		t.Errorf("text = %q", v["text"])
+	}
+	blocks := v["blocks"].([]any)
+	var types []string
+	for _, b := range blocks {
+		types = append(types, b.(map[string]any)["type"].(string))
+	}
+	if got := strings.Join(types, ","); got != "header,section,context,divider,header,context" {
+		t.Errorf("block types = %v", got)
+	}
+	section := blocks[1].(map[string]any)["text"].(map[string]any)
+	if section["type"] != "mrkdwn" || section["text"] != "*db1* at 99%" {
+		t.Errorf("section = %v", section)
+	}
+	context := blocks[2].(map[string]any)["elements"].([]any)
+	if len(context) != 2 || context[0].(map[string]any)["text"] != "monitor" ||
+		context[1].(map[string]any)["text"] != "priority: high" {
+		t.Errorf("context = %v", context)
+	}
+	header := blocks[4].(map[string]any)["text"].(map[string]any)["text"].(string)
+	if n := len([]rune(header)); n > 150 {
+		t.Errorf("header has %d characters", n)
+	}
+}
+
+func TestDiscordRequest(t *testing.T) {
+	rcv := newStubReceiver(t, ok)
+	s := Session{stubSession{hook: rcv.URL + "/api/webhooks/1/x"}}
+	var ms []*Message
+	for i := 0; i < 12; i++ {
+		ms = append(ms, &Message{Title: "alert", Content: "down", Author: "probe", Priority: PriorityCritical})
+	}
+	post(t, discordChannel{}, s, digest(ms...))
+	embeds := decode(t, rcv.bodies[0])["embeds"].([]any)
+	if len(embeds) != 10 {
+		t.Fatalf("%d embeds, want 10", len(embeds))
+	}
+	e := embeds[0].(map[string]any)
+	if e["title"] != "alert" || e["description"] != "down" || e["author"].(map[string]any)["name"] != "probe" {
+		t.Errorf("embed = %v", e)
+	}
+	if int(e["color"].(float64)) != discordColors[PriorityCritical] {
+		t.Errorf("color = %v", e["color"])
+	}
+	if e["footer"].(map[string]any)["text"] != "critical" {
+		t.Errorf("footer = %v", e["footer"])
+	}
+}
+
+func TestDiscordTotal(t *testing.T) {
+	var ms []*Message
+	for i := 0; i < 10; i++ {
+		ms = append(ms, &Message{Title: "alert", Content: strings.Repeat("x", 4096), Priority: PriorityHigh})
+	}
+	req, err := discordChannel{}.Request(Session{stubSession{}}, digest(ms...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, e := range decode(t, req.Body)["embeds"].([]any) {
+		e := e.(map[string]any)
+		for _, k := range []string{"title", "description"} {
+			s, _ := e[k].(string)
+			total += len([]rune(s))
+		}
+		total += len([]rune(e["footer"].(map[string]any)["text"].(string)))
+	}
+	if total > discordTotal {
+		t.Errorf("embeds hold %d characters, limit %d", total, discordTotal)
+	}
+}
+
+func TestTeamsRequest(t *testing.T) {
+	rcv := newStubReceiver(t, ok)
+	s := Session{stubSession{hook: rcv.URL + "/webhook"}}
+	post(t, teamsChannel{}, s, wsgo.H{"message": &Message{Title: "Deploy failed", Content: "build 42", Priority: PriorityCritical}})
+	v := decode(t, rcv.bodies[0])
+	if v["type"] != "message" {
+		t.Errorf("type = %v", v["type"])
+	}
+	att := v["attachments"].([]any)[0].(map[string]any)
+	if att["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("contentType = %v", att["contentType"])
+	}
+	card := att["content"].(map[string]any)
+	if card["type"] != "AdaptiveCard" {
+		t.Errorf("card type = %v", card["type"])
+	}
+	body := card["body"].([]any)
+	if len(body) != 2 {
+		t.Fatalf("%d card items, want 2", len(body))
+	}
+	title := body[0].(map[string]any)
+	if title["text"] != "Deploy failed" || title["color"] != "Attention" {
+		t.Errorf("title = %v", title)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		ch      Channel
+		respond func(w http.ResponseWriter)
+		wait    time.Duration
+		limited bool
+	}{
+		{"slack retry-after", slackChannel{}, func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}, 30 * time.Second, true},
+		{"slack ok", slackChannel{}, ok, 0, false},
+		{"discord retry_after", discordChannel{}, func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 1.5, "global": false}`))
+		}, 1500 * time.Millisecond, true},
+		{"teams connector body", teamsChannel{}, func(w http.ResponseWriter) {
+			w.Write([]byte("Microsoft Teams endpoint returned HTTP error 429 with ContextId ..."))
+		}, 0, true},
+		{"teams unavailable", teamsChannel{}, func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newStubReceiver(t, tt.respond)
+			resp, body := post(t, tt.ch, Session{stubSession{hook: rcv.URL}}, wsgo.H{"message": &Message{Title: "x"}})
+			wait, limited := tt.ch.RateLimited(resp, body)
+			if wait != tt.wait || limited != tt.limited {
+				t.Errorf("RateLimited = %v, %v; want %v, %v", wait, limited, tt.wait, tt.limited)
+			}
+		})
+	}
+}
+
+// sendOnce renders m for the channel and sends it with a job bound to srv.
+func sendOnce(t *testing.T, srv *Server, name string, s Session, m *Message) error {
+	t.Helper()
+	req, err := srv.channel(name).Request(s, wsgo.H{"message": m})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	req.Channel = name
+	job := NewPushToSessionJob(req, m)
+	job.bind(srv)
+	_, err = job.send()
+	return err
+}
+
+// rescheduled returns the job waiting in entries and when it is due.
+func rescheduled(t *testing.T, entries *memEntries) (*PushToSessionJob, time.Time) {
+	t.Helper()
+	if len(entries.entries) != 1 {
+		t.Fatalf("%d jobs scheduled, want 1", len(entries.entries))
+	}
+	e := entries.entries[0]
+	return e.Job().(*PushToSessionJob), e.Schedule().Next(time.Now())
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	rcv := newStubReceiver(t, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	srv, entries := testServer()
+	start := time.Now()
+	err := sendOnce(t, srv, ChannelSlack, Session{stubSession{hook: rcv.URL}}, &Message{Title: "x", Priority: PriorityNormal})
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("send = %v, want rate limited", err)
+	}
+	job, at := rescheduled(t, entries)
+	if job.limited != 1 || job.attempt != 0 {
+		t.Errorf("limited %d attempt %d, want 1 0", job.limited, job.attempt)
+	}
+	if d := at.Sub(start); d < 7*time.Second || d > 8*time.Second {
+		t.Errorf("retry in %v, want 7s", d)
+	}
+}
+
+func TestRateLimitRetryFallsBack(t *testing.T) {
+	rcv := newStubReceiver(t, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	srv, entries := testServer()
+	req, err := discordChannel{}.Request(Session{stubSession{hook: rcv.URL}}, wsgo.H{"message": &Message{Title: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Channel = ChannelDiscord
+	job := NewPushToSessionJob(req, &Message{Priority: PriorityNormal})
+	job.limited = maxRateLimited
+	job.bind(srv)
+	job.send()
+	next, _ := rescheduled(t, entries)
+	if next.attempt != 1 || next.limited != maxRateLimited {
+		t.Errorf("attempt %d limited %d, want a normal retry", next.attempt, next.limited)
+	}
+}
+
+func TestAckLinks(t *testing.T) {
+	ack := wsgo.H{"delivery": "d1", "token": "t1", "url": "https://push.example/delivery/ack?d=1",
+		"read_url": "https://push.example/delivery/ack?d=1&read=true"}
+	hook := Session{stubSession{hook: "https://hooks.example/x"}}
+	tests := []struct {
+		name string
+		ch   Channel
+		s    Session
+		path func(v map[string]any) any
+	}{
+		{"slack", slackChannel{}, hook, func(v map[string]any) any {
+			blocks := v["blocks"].([]any)
+			return blocks[len(blocks)-1].(map[string]any)["elements"].([]any)[0].(map[string]any)["url"]
+		}},
+		{"discord", discordChannel{}, hook, func(v map[string]any) any {
+			return v["content"]
+		}},
+		{"teams", teamsChannel{}, hook, func(v map[string]any) any {
+			card := v["attachments"].([]any)[0].(map[string]any)["content"].(map[string]any)
+			return card["actions"].([]any)[0].(map[string]any)["url"]
+		}},
+		{"telegram", telegramChannel{}, telegramSession(""), func(v map[string]any) any {
+			return v["reply_markup"].(map[string]any)["inline_keyboard"].([]any)[0].([]any)[1].(map[string]any)["url"]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := tt.ch.Request(tt.s, wsgo.H{"message": &Message{Title: "x"}, "ack": ack})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := tt.path(decode(t, req.Body)).(string)
+			if !strings.Contains(got, "https://push.example/delivery/ack?d=1") {
+				t.Errorf("ack link = %q", got)
+			}
+			req, _ = tt.ch.Request(tt.s, wsgo.H{"message": &Message{Title: "x"}, "ack": wsgo.H(nil)})
+			if strings.Contains(string(req.Body), "Acknowledge") {
+				t.Errorf("ack links without an ack: %s", req.Body)
+			}
+		})
+	}
+}
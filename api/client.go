@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// ClientConfig configures the HTTP client deliveries are sent with. Timeout
+// bounds a whole request, reading the response included. CAFile adds a PEM
+// bundle to the system roots; CertFile and KeyFile are a client certificate
+// offered to hooks requiring mutual TLS.
+type ClientConfig struct {
+	ConnectTimeout      time.Duration
+	Timeout             time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	Proxy               string
+	CAFile              string
+	CertFile            string
+	KeyFile             string
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{ConnectTimeout: 10 * time.Second, Timeout: 30 * time.Second, MaxIdleConns: 100,
+		MaxIdleConnsPerHost: 10, IdleConnTimeout: 90 * time.Second}
+}
+
+// ProxyDirect as a session proxy bypasses the configured one.
+const ProxyDirect = "direct"
+
+func durationOption(name string, v string, d time.Duration) (time.Duration, error) {
+	if v == "" {
+		return d, nil
+	}
+	t, err := time.ParseDuration(v)
+	if err == nil && t <= 0 {
+		err = fmt.Errorf("not positive")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%v %q: %v", name, v, err)
+	}
+	return t, nil
+}
+
+// proxyAddr returns the host:port a proxy is dialed at.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// newClient builds a delivery client from cfg with the session options o,
+// enforcing the outbound policy. Connections to the proxy of the server
+// configuration are not checked by the dialer, while session proxies are
+// checked like any hook; the addresses of proxied hosts are resolved and
+// checked before sending instead.
+func newClient(p *outbound, cfg ClientConfig, o database.ClientOptions) (*http.Client, error) {
+	connect, err := durationOption("connect timeout", o.ConnectTimeout, cfg.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := durationOption("timeout", o.Timeout, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	proxy := cfg.Proxy
+	if o.Proxy == ProxyDirect {
+		proxy = ""
+	} else if o.Proxy != "" {
+		proxy = o.Proxy
+	}
+	tlsCfg := &tls.Config{}
+	if cfg.CAFile != "" || o.CA != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if cfg.CAFile != "" {
+			b, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("ca file: %v", err)
+			}
+			if !roots.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("ca file %v: no certificates", cfg.CAFile)
+			}
+		}
+		if o.CA != "" && !roots.AppendCertsFromPEM([]byte(o.CA)) {
+			return nil, fmt.Errorf("ca: no certificates")
+		}
+		tlsCfg.RootCAs = roots
+	}
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(o.Cert), []byte(o.Key))
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	} else if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	checked := &net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second, Control: p.control}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = checked.DialContext
+	tr.TLSClientConfig = tlsCfg
+	tr.MaxIdleConns = cfg.MaxIdleConns
+	tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	tr.IdleConnTimeout = cfg.IdleConnTimeout
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+			err = fmt.Errorf("unsupported proxy")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("proxy %q: %v", proxy, err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+		if proxy == cfg.Proxy {
+			direct := &net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}
+			addr := proxyAddr(u)
+			tr.DialContext = func(ctx context.Context, network string, a string) (net.Conn, error) {
+				if a == addr {
+					return direct.DialContext(ctx, network, a)
+				}
+				return checked.DialContext(ctx, network, a)
+			}
+		}
+	}
+	return &http.Client{
+		Transport: policyTransport{o: p, base: tr, resolve: proxy != ""},
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", ErrBlocked, p.MaxRedirects)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// SetClientConfig sets the client deliveries are sent with.
+func (s *Server) SetClientConfig(cfg ClientConfig) error {
+	c, err := newClient(s.outbound, cfg, database.ClientOptions{})
+	if err != nil {
+		return err
+	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clientCfg, s.client, s.clients = cfg, c, map[database.ClientOptions]*http.Client{}
+	return nil
+}
+
+// sessionClient returns the client for the session, built once per set of
+// session options so connections are pooled.
+func (s *Server) sessionClient(session database.Session) (*http.Client, error) {
+	o := session.GetClientOptions()
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if o == (database.ClientOptions{}) {
+		return s.client, nil
+	}
+	if c, ok := s.clients[o]; ok {
+		return c, nil
+	}
+	c, err := newClient(s.outbound, s.clientCfg, o)
+	if err != nil {
+		return nil, fmt.Errorf("session %v client: %v", session.GetID(), err)
+	}
+	s.clients[o] = c
+	return c, nil
+}
+
+func (s *Server) handleClient(r *wsgo.ServerMux) {
+	// override the delivery client for a session; empty values keep the server settings
+	// session={sessionid}&connect_timeout={10s}&timeout={30s}&proxy={url|direct}&ca={pem}&cert={pem}&key={pem}
+	r.Handle(s.prefix+"/session/setclient", requireString("session"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid := ps["session"]
+		o := database.ClientOptions{ConnectTimeout: ps["connect_timeout"], Timeout: ps["timeout"], Proxy: ps["proxy"],
+			CA: ps["ca"], Cert: ps["cert"], Key: ps["key"]}
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			_, err = newClient(s.outbound, s.clientCfg, o)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetClientOptions(o); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set client: %v", sid, err)
+			return
+		}
+	})
+}
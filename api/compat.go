@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// Aliases let tools speaking other push APIs reach groups and sessions. A
+// Gotify app token, an ntfy topic or the last path segment of an alert
+// webhook is the alias key.
+const (
+	AliasGotify       = "gotify"
+	AliasNtfy         = "ntfy"
+	AliasAlertmanager = "alertmanager"
+	AliasGrafana      = "grafana"
+)
+
+func checkAliasKind(kind string) error {
+	switch kind {
+	case AliasGotify, AliasNtfy, AliasAlertmanager, AliasGrafana:
+		return nil
+	}
+	return fmt.Errorf("unknown alias kind: %s", kind)
+}
+
+// newToken returns a random token shaped like a Gotify app token.
+func newToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "A" + base64.RawURLEncoding.EncodeToString(b)[:14]
+}
+
+// maskKey hides all but the start of a key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:4] + strings.Repeat("*", len(key)-4)
+}
+
+// aliasWsgoH describes an alias. Keys are masked as they authorize pushes,
+// and are only shown in full when created; ntfy topics protected by an access
+// token are the exception.
+func aliasWsgoH(a database.Alias) wsgo.H {
+	key := a.GetKey()
+	if a.GetKind() != AliasNtfy || a.GetToken() == "" {
+		key = maskKey(key)
+	}
+	return wsgo.H{"kind": a.GetKind(), "key": key, "group": a.GetGroupID(), "session": a.GetSessionID(),
+		"protected": a.GetToken() != "", "created": a.GetCreated()}
+}
+
+// gotifyPriority maps Gotify's 0-10 scale.
+func gotifyPriority(n int) Priority {
+	switch {
+	case n <= 3:
+		return PriorityLow
+	case n <= 7:
+		return PriorityNormal
+	case n <= 9:
+		return PriorityHigh
+	}
+	return PriorityCritical
+}
+
+// ntfyPriority maps ntfy's 1-5 scale and its names.
+func ntfyPriority(s string) (Priority, int, error) {
+	switch strings.ToLower(s) {
+	case "1", "min":
+		return PriorityLow, 1, nil
+	case "2", "low":
+		return PriorityLow, 2, nil
+	case "", "3", "default":
+		return PriorityNormal, 3, nil
+	case "4", "high":
+		return PriorityHigh, 4, nil
+	case "5", "max", "urgent":
+		return PriorityCritical, 5, nil
+	}
+	return "", 0, fmt.Errorf("invalid ntfy priority: %s", s)
+}
+
+// formParams returns the query and, for form posts, the body values. The body
+// has already been read by the JSON middleware, so it is put back first.
+func formParams(c *wsgo.Context) url.Values {
+	r := c.GetRequest()
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/x-www-form-urlencoded" || ct == "multipart/form-data" {
+		if b, err := c.ReadAllBody(); err == nil {
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			r.ParseMultipartForm(1 << 20)
+		}
+	}
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	return r.Form
+}
+
+// firstValue returns the first non-empty param, JSON body params first, then
+// form and query values, then headers.
+func firstValue(c *wsgo.Context, form url.Values, names ...string) string {
+	for _, n := range names {
+		if v, ok := c.Param(n); ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	for _, n := range names {
+		if v := form.Get(n); v != "" {
+			return v
+		}
+	}
+	for _, n := range names {
+		if v := c.GetRequest().Header.Get(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// requestToken reads a token from a bearer or basic (as the password)
+// authorization header.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if _, p, ok := r.BasicAuth(); ok {
+		return p
+	}
+	return ""
+}
+
+// pushAlias pushes m to the alias target right away and returns the delivery
+// id when the target is a session.
+func (s *Server) pushAlias(c *wsgo.Context, a database.Alias, m *Message) (string, error) {
+	if sid := a.GetSessionID(); sid != "" {
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			return "", err
+		}
+		r := Session{session}.Push(m, s)
+		if accepted(r.Err) {
+			return r.Delivery, nil
+		}
+		return r.Delivery, r.Err
+	}
+	g, err := s.db.GetGroupByID(a.GetGroupID())
+	if err != nil {
+		return "", err
+	}
+	resps, err := Group{g}.Push(m, s)
+	if err != nil {
+		return "", err
+	}
+	for _, resp := range resps {
+		if resp.Err != nil && !accepted(resp.Err) {
+			c.Log("push to group session %v: %v", resp.Session.GetID(), resp.Err)
+		}
+	}
+	return "", nil
+}
+
+func (s *Server) handleCompat(r *wsgo.ServerMux) {
+	// map a compatibility key to a group or a session; keys other than ntfy topics are generated if not given
+	// kind={gotify|ntfy|alertmanager|grafana}&key={}&group={groupid}&session={sessionid}&token={access token}
+	r.Handle(s.prefix+"/alias/create", requireString("kind"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		kind, key, gid, sid := ps["kind"], ps["key"], ps["group"], ps["session"]
+		err := checkAliasKind(kind)
+		if err == nil && (gid == "") == (sid == "") {
+			err = fmt.Errorf("exactly one of group and session is required")
+		}
+		if err == nil && key == "" {
+			if kind == AliasNtfy {
+				err = fmt.Errorf("%v alias needs a key", kind)
+			}
+			key = newToken()
+		}
+		if err == nil && kind != AliasGotify && strings.ContainsAny(key, "/?#") {
+			err = fmt.Errorf("invalid %v key: %v", kind, key)
+		}
+		if err == nil && gid != "" {
+			_, err = s.db.GetGroupByID(gid)
+		}
+		if err == nil && sid != "" {
+			_, err = s.db.GetSessionByID(sid)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := s.db.NewAlias(kind, key, ps["token"], gid, sid); err != nil {
+			c.String(http.StatusConflict, http.StatusText(http.StatusConflict))
+			c.Log("NewAlias: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, wsgo.H{"kind": kind, "key": key})
+	})
+	// kind={gotify|ntfy|alertmanager|grafana}&key={}
+	r.Handle(s.prefix+"/alias/delete", requireString("kind", "key"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		if err := s.db.DeleteAlias(ps["kind"], ps["key"]); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.String(http.StatusOK, "")
+	})
+	// kind={gotify|ntfy|alertmanager|grafana}
+	r.Handle(s.prefix+"/alias/list", func(c *wsgo.Context) {
+		as, err := s.db.GetAliases(c.DefaultStringParam("kind", ""))
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("GetAliases: %v", err)
+			return
+		}
+		ret := []wsgo.H{}
+		for _, a := range as {
+			ret = append(ret, aliasWsgoH(a))
+		}
+		c.Json(http.StatusOK, ret)
+	})
+	// Gotify POST /message; the app token is given as X-Gotify-Key, token or a bearer token
+	// title={}&message={}&priority={0-10}
+	r.POST(s.prefix+"/gotify/message", func(c *wsgo.Context) {
+		req := c.GetRequest()
+		form := formParams(c)
+		token := req.Header.Get("X-Gotify-Key")
+		if token == "" {
+			token = form.Get("token")
+		}
+		if token == "" {
+			token = requestToken(req)
+		}
+		a, err := s.db.GetAlias(AliasGotify, token)
+		if token == "" || err != nil {
+			c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			c.Log("Unauthorized: %v", err)
+			return
+		}
+		m := Message{Title: firstValue(c, form, "title"), Content: firstValue(c, form, "message"), Priority: PriorityNormal}
+		level := -1
+		if n, ok, err := intParam(c, "priority"); ok {
+			if err != nil {
+				c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+				c.Log("Bad Request: %v", err)
+				return
+			}
+			level = n
+		} else if v := form.Get("priority"); v != "" {
+			if level, err = strconv.Atoi(v); err != nil {
+				c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+				c.Log("Bad Request: invalid priority: %v", err)
+				return
+			}
+		}
+		if level >= 0 {
+			m.Priority = gotifyPriority(level)
+		}
+		if m.Content == "" {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: message is required")
+			return
+		}
+		if _, err := s.pushAlias(c, a, &m); err != nil {
+			c.String(http.StatusNotAcceptable, http.StatusText(http.StatusNotAcceptable))
+			c.Log("push to gotify alias %v: %v", a.GetKey(), err)
+			return
+		}
+		if level < 0 {
+			level = 0
+		}
+		c.Json(http.StatusOK, wsgo.H{"appid": 0, "title": m.Title, "message": m.Content, "priority": level,
+			"date": time.Now().Format(time.RFC3339)})
+	})
+	// ntfy PUT/POST /{topic} with the message as body, or POST / with a JSON body holding the topic
+	// headers or params: title|t, priority|p, message|m
+	r.Handle(s.prefix+"/ntfy/*", func(c *wsgo.Context) {
+		req := c.GetRequest()
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			c.String(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			c.Log("ntfy %v is not supported", req.Method)
+			return
+		}
+		form := formParams(c)
+		topic := strings.TrimPrefix(req.URL.Path, s.prefix+"/ntfy/")
+		var m Message
+		if topic == "" {
+			topic, _ = c.StringParam("topic")
+			m.Title, _ = c.StringParam("title")
+			m.Content, _ = c.StringParam("message")
+		} else {
+			m.Title = firstValue(c, form, "X-Title", "title", "ti", "t")
+			m.Content = form.Get("message")
+			if m.Content == "" {
+				m.Content = form.Get("m")
+			}
+			if m.Content == "" {
+				b, _ := c.ReadAllBody()
+				m.Content = strings.TrimSpace(string(b))
+			}
+		}
+		p := firstValue(c, form, "X-Priority", "priority", "prio", "p")
+		var level int
+		var err error
+		if m.Priority, level, err = ntfyPriority(p); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		a, err := s.db.GetAlias(AliasNtfy, topic)
+		if err != nil {
+			c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			c.Log("ntfy topic %q: %v", topic, err)
+			return
+		}
+		if t := a.GetToken(); t != "" && requestToken(req) != t {
+			c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			c.Log("Unauthorized: ntfy topic %q", topic)
+			return
+		}
+		if m.Content == "" {
+			m.Content = "triggered"
+		}
+		delivery, err := s.pushAlias(c, a, &m)
+		if err != nil {
+			c.String(http.StatusNotAcceptable, http.StatusText(http.StatusNotAcceptable))
+			c.Log("push to ntfy topic %v: %v", topic, err)
+			return
+		}
+		c.Json(http.StatusOK, wsgo.H{"id": delivery, "time": time.Now().Unix(), "event": "message", "topic": topic,
+			"title": m.Title, "message": m.Content, "priority": level})
+	})
+}
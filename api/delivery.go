@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryScheduled = "scheduled"
+	DeliveryDeferred  = "deferred"
+	DeliveryBatched   = "batched"
+	DeliveryRetrying  = "retrying"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryExpired   = "expired"
+	DeliveryDropped   = "dropped"
+)
+
+// accepted reports whether a push error only means the message was not sent
+// right away.
+func accepted(err error) bool {
+	return errors.Is(err, ErrDeferred) || errors.Is(err, ErrDropped) || errors.Is(err, ErrExpired) || errors.Is(err, ErrBatched) ||
+		errors.Is(err, ErrCircuitOpen)
+}
+
+type Delivery struct {
+	database.Delivery
+}
+
+func (d Delivery) WsgoH() wsgo.H {
+	r := wsgo.H{"id": d.GetID(), "session": d.GetSessionID(), "message": d.GetMessage(), "status": d.GetStatus(),
+		"detail": d.GetDetail(), "created": d.GetCreated(), "updated": d.GetUpdated()}
+	if t := d.GetAckedAt(); !t.IsZero() {
+		r["acked"] = t
+	}
+	if t := d.GetReadAt(); !t.IsZero() {
+		r["read"] = t
+	}
+	return r
+}
+
+// setDeliveryStatus updates a delivery record, logging failures. Jobs saved
+// before deliveries were recorded have no id and are skipped.
+func (s *Server) setDeliveryStatus(id string, status string, detail string) {
+	if id == "" {
+		return
+	}
+	d, err := s.db.GetDeliveryByID(id)
+	if err == nil {
+		err = d.SetStatus(status, detail)
+	}
+	if err != nil {
+		fmt.Printf("delivery %v set status %v: %v\n", id, status, err)
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+var ErrBatched = errors.New("batched into digest")
+
+type digestItem struct {
+	Delivery string   `json:"delivery"`
+	Message  *Message `json:"message"`
+}
+
+func digestEnabled(d database.Digest) bool {
+	return d.Interval != "" || d.Cron != ""
+}
+
+// digestSchedule returns the schedule flushing the session's digest d.
+func (s Session) digestSchedule(d database.Digest) (database.Schedule, error) {
+	if d.Interval != "" && d.Cron != "" {
+		return nil, fmt.Errorf("digest takes either interval or cron")
+	}
+	if d.MaxBatch < 0 {
+		return nil, fmt.Errorf("invalid digest max batch: %d", d.MaxBatch)
+	}
+	if d.Cron != "" {
+		return NewCronSchedule(d.Cron, s.location())
+	}
+	every, err := time.ParseDuration(d.Interval)
+	if err != nil {
+		sec, err2 := strconv.ParseInt(d.Interval, 10, 64)
+		if err2 != nil {
+			return nil, fmt.Errorf("invalid digest interval: %v", err)
+		}
+		every = time.Duration(sec) * time.Second
+	}
+	if every < time.Minute {
+		return nil, fmt.Errorf("digest interval must be at least a minute")
+	}
+	return NewIntervalSchedule(every), nil
+}
+
+// SetDigest replaces the session's digest settings and the scheduler entry
+// flushing it. Disabling the digest delivers whatever is still waiting.
+func (s Session) SetDigest(d database.Digest, srv *Server) error {
+	var schedule database.Schedule
+	if digestEnabled(d) {
+		var err error
+		if schedule, err = s.digestSchedule(d); err != nil {
+			return err
+		}
+	}
+	if old := s.GetDigest().Entry; old != "" {
+		if err := srv.removeEntry(old); err != nil {
+			fmt.Printf("session %v setDigest: %v\n", s.GetID(), err)
+		}
+	}
+	d.Entry = ""
+	if schedule != nil {
+		e := srv.scheduler.AddJob(NewDigestFlushJob(s.GetID()), schedule)
+		d.Entry = e.(database.Entry).GetID()
+	}
+	if err := s.Session.SetDigest(d); err != nil {
+		return err
+	}
+	if schedule == nil {
+		return s.FlushDigest(srv)
+	}
+	return nil
+}
+
+// addToDigest queues m for the next digest, flushing early once the batch is full.
+func (s Session) addToDigest(m *Message, srv *Server, delivery string) error {
+	b, err := json.Marshal(digestItem{Delivery: delivery, Message: m})
+	if err != nil {
+		return fmt.Errorf("session addToDigest: %v", err)
+	}
+	n, err := s.AppendDigest(string(b))
+	if err != nil {
+		return err
+	}
+	srv.setDeliveryStatus(delivery, DeliveryBatched, "")
+	if max := s.GetDigest().MaxBatch; max > 0 && n >= max {
+		return s.FlushDigest(srv)
+	}
+	return nil
+}
+
+// FlushDigest delivers the queued messages as one payload. During quiet hours
+// the queue is kept until the next flush.
+func (s Session) FlushDigest(srv *Server) error {
+	if !s.quietUntil(time.Now()).IsZero() {
+		return nil
+	}
+	raw, err := s.TakeDigest()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	batch := Message{Priority: PriorityLow}
+	messages := []*Message{}
+	deliveries := []string{}
+	for _, r := range raw {
+		var it digestItem
+		if err := json.Unmarshal([]byte(r), &it); err != nil || it.Message == nil {
+			fmt.Printf("session %v digest: bad item %q\n", s.GetID(), r)
+			continue
+		}
+		if it.Message.expired(now) {
+			srv.setDeliveryStatus(it.Delivery, DeliveryExpired, "")
+			continue
+		}
+		if it.Message.Priority.Level() > batch.Priority.Level() {
+			batch.Priority = it.Message.Priority
+		}
+		// the batch is worth sending until its last message expires
+		if len(messages) == 0 || (batch.ExpiresAt != 0 && (it.Message.ExpiresAt == 0 || it.Message.ExpiresAt > batch.ExpiresAt)) {
+			batch.ExpiresAt = it.Message.ExpiresAt
+		}
+		messages = append(messages, it.Message)
+		deliveries = append(deliveries, it.Delivery)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	acks := []wsgo.H{}
+	for _, d := range deliveries {
+		acks = append(acks, srv.ackInfo(d))
+	}
+	req, err := s.request(srv, wsgo.H{"session": s.WsgoHWithGroup(), "digest": true, "messages": messages, "acks": acks})
+	if err != nil {
+		// the queue is already taken; requeueing would fail the same way
+		for _, d := range deliveries {
+			srv.setDeliveryStatus(d, DeliveryFailed, err.Error())
+		}
+		return fmt.Errorf("session flushDigest: %v", err)
+	}
+	job := NewPushToSessionJob(req, &batch, deliveries...)
+	job.bind(srv)
+	_, err = job.send()
+	return err
+}
@@ -9,11 +9,66 @@ type ApiEntry struct {
 
 var Docs []ApiEntry = []ApiEntry{
 	{Api: "/group/create", OtherParams: []string{"data"}, ReturnValue: "group id"},
-	{Api: "/group/push", StringParams: []string{"group", "author", "title", "content", "when"}, OtherParams: []string{"ids of pushed sessions"}},
+	{Api: "/group/push", StringParams: []string{"group", "author", "title", "content", "priority", "when", "ttl", "expires_at", "template", "render", "topic", "tags"}, OtherParams: []string{"vars"}, ReturnValue: "ids of pushed sessions, or the resolved time if scheduled"},
+	{Api: "/group/settemplate", StringParams: []string{"group", "name", "author", "title", "content"}, ReturnValue: "empty"},
+	{Api: "/group/deltemplate", StringParams: []string{"group", "name"}, ReturnValue: "empty"},
+	{Api: "/group/templates", StringParams: []string{"group"}, ReturnValue: "templates by name"},
 	{Api: "/group/setdata", StringParams: []string{"group"}, OtherParams: []string{"data"}, ReturnValue: "empty"},
-	{Api: "/session/create", StringParams: []string{"group", "hook", "data"}, ReturnValue: "session id"},
-	{Api: "/session/push", StringParams: []string{"session", "author", "title", "content", "when"}, ReturnValue: "empty"},
-	{Api: "/session/check", StringParams: []string{"session"}, ReturnValue: "session info"},
+	{Api: "/session/create", StringParams: []string{"group", "hook", "data", "channel", "verify"}, ReturnValue: "session id and verification state"},
+	{Api: "/session/push", StringParams: []string{"session", "author", "title", "content", "priority", "when", "ttl", "expires_at", "template", "render", "ack_timeout", "escalate_session", "escalate_group"}, OtherParams: []string{"vars"}, ReturnValue: "delivery id and the resolved time if scheduled"},
+	{Api: "/session/check", StringParams: []string{"session"}, ReturnValue: "session info with client options and health"},
 	{Api: "/session/setdata", StringParams: []string{"session"}, OtherParams: []string{"data"}, ReturnValue: "empty"},
 	{Api: "/session/hide", StringParams: []string{"session"}, ReturnValue: "empty"},
+	{Api: "/session/setdigest", StringParams: []string{"session", "interval", "cron"}, OtherParams: []string{"max"}, ReturnValue: "empty"},
+	{Api: "/session/flushdigest", StringParams: []string{"session"}, ReturnValue: "empty"},
+	{Api: "/session/setformat", StringParams: []string{"session", "type", "body", "method"}, OtherParams: []string{"fields", "headers"}, ReturnValue: "empty"},
+	{Api: "/session/setchannel", StringParams: []string{"session", "channel"}, ReturnValue: "empty"},
+	{Api: "/session/settopics", StringParams: []string{"session"}, OtherParams: []string{"topics"}, ReturnValue: "empty"},
+	{Api: "/session/settags", StringParams: []string{"session"}, OtherParams: []string{"tags"}, ReturnValue: "empty"},
+	{Api: "/group/setparent", StringParams: []string{"group", "parent"}, ReturnValue: "empty"},
+	{Api: "/group/tree", StringParams: []string{"group"}, ReturnValue: "group with nested children"},
+	{Api: "/group/members", StringParams: []string{"group", "topic", "tags"}, ReturnValue: "list of sessions reached by a push"},
+	{Api: "/session/addgroup", StringParams: []string{"session", "group"}, ReturnValue: "empty"},
+	{Api: "/session/removegroup", StringParams: []string{"session", "group"}, ReturnValue: "empty"},
+	{Api: "/session/unhide", StringParams: []string{"session"}, ReturnValue: "empty"},
+	{Api: "/session/delete", StringParams: []string{"session", "hard"}, ReturnValue: "empty"},
+	{Api: "/session/restore", StringParams: []string{"session"}, ReturnValue: "empty"},
+	{Api: "/group/delete", StringParams: []string{"group", "sessions", "hard"}, ReturnValue: "empty"},
+	{Api: "/group/restore", StringParams: []string{"group"}, ReturnValue: "empty"},
+	{Api: "/group/list", StringParams: []string{"limit", "cursor", "sort", "parent"}, OtherParams: []string{"data"}, ReturnValue: "page of groups and next cursor"},
+	{Api: "/session/list", StringParams: []string{"limit", "cursor", "sort", "hidden", "group", "host"}, OtherParams: []string{"data"}, ReturnValue: "page of sessions and next cursor"},
+	{Api: "/session/move", StringParams: []string{"session", "group"}, ReturnValue: "empty"},
+	{Api: "/session/detach", StringParams: []string{"session"}, ReturnValue: "empty"},
+	{Api: "/session/sethook", StringParams: []string{"session", "hook", "verify"}, ReturnValue: "empty, or the verification state when verifying"},
+	{Api: "/session/verify", StringParams: []string{"session", "challenge"}, ReturnValue: "verification state"},
+	{Api: "/session/verify/resend", StringParams: []string{"session"}, ReturnValue: "verification state"},
+	{Api: "/session/setclient", StringParams: []string{"session", "connect_timeout", "timeout", "proxy", "ca", "cert", "key"}, ReturnValue: "empty"},
+	{Api: "/session/audit", StringParams: []string{"session", "limit"}, ReturnValue: "list of changes"},
+	{Api: "/delivery/check", StringParams: []string{"delivery"}, ReturnValue: "delivery info"},
+	{Api: "/delivery/ack", StringParams: []string{"delivery", "token", "read"}, ReturnValue: "delivery status with ack and read times"},
+	{Api: "/group/setescalation", StringParams: []string{"group", "timeout", "fallback_group", "fallback_session"}, OtherParams: []string{"tiers", "repeat"}, ReturnValue: "empty"},
+	{Api: "/escalation/list", StringParams: []string{"group", "status", "limit"}, ReturnValue: "list of escalations"},
+	{Api: "/escalation/check", StringParams: []string{"escalation"}, ReturnValue: "escalation state"},
+	{Api: "/escalation/cancel", StringParams: []string{"escalation"}, ReturnValue: "empty"},
+	{Api: "/recurring/create", StringParams: []string{"session", "group", "author", "title", "content", "priority", "topic", "tags", "ttl", "interval", "cron", "timezone", "start", "end", "max", "next"}, ReturnValue: "recurring push with next run times"},
+	{Api: "/recurring/list", StringParams: []string{"session", "group", "status", "limit"}, ReturnValue: "list of recurring pushes"},
+	{Api: "/recurring/check", StringParams: []string{"recurring", "next"}, ReturnValue: "recurring push with next run times"},
+	{Api: "/recurring/pause", StringParams: []string{"recurring"}, ReturnValue: "empty"},
+	{Api: "/recurring/resume", StringParams: []string{"recurring", "next"}, ReturnValue: "recurring push with next run times"},
+	{Api: "/recurring/delete", StringParams: []string{"recurring"}, ReturnValue: "empty"},
+	{Api: "/alias/create", StringParams: []string{"kind", "key", "group", "session", "token"}, ReturnValue: "kind and key"},
+	{Api: "/alias/delete", StringParams: []string{"kind", "key"}, ReturnValue: "empty"},
+	{Api: "/alias/list", StringParams: []string{"kind"}, ReturnValue: "list of aliases"},
+	{Api: "/gotify/message", StringParams: []string{"token", "title", "message"}, OtherParams: []string{"priority"}, ReturnValue: "gotify message"},
+	{Api: "/ntfy/{topic}", StringParams: []string{"title", "priority", "message"}, ReturnValue: "ntfy message"},
+	{Api: "/alertmanager/{key}", StringParams: []string{"group_by"}, OtherParams: []string{"alertmanager webhook payload"}, ReturnValue: "delivery ids"},
+	{Api: "/rule/create", StringParams: []string{"name", "group", "author", "title", "content", "priority"}, OtherParams: []string{"signature"}, ReturnValue: "rule id"},
+	{Api: "/rule/update", StringParams: []string{"rule", "name", "group", "author", "title", "content", "priority"}, OtherParams: []string{"signature"}, ReturnValue: "rule info"},
+	{Api: "/rule/delete", StringParams: []string{"rule"}, ReturnValue: "empty"},
+	{Api: "/rule/check", StringParams: []string{"rule"}, ReturnValue: "rule info"},
+	{Api: "/rule/list", ReturnValue: "list of rules"},
+	{Api: "/hook/{rule}", OtherParams: []string{"any json"}, ReturnValue: "ids of pushed sessions"},
+	{Api: "/grafana/{key}", StringParams: []string{"group_by"}, OtherParams: []string{"grafana webhook payload"}, ReturnValue: "delivery ids"},
+	{Api: "/session/settimezone", StringParams: []string{"session", "timezone"}, ReturnValue: "empty"},
+	{Api: "/session/setquiet", StringParams: []string{"session", "action"}, OtherParams: []string{"windows"}, ReturnValue: "empty"},
 }
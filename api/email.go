@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const ChannelEmail = "email"
+
+// SMTPConfig is the mail server used by email sessions.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// StartTLS upgrades a plain connection; TLS connects over TLS right away.
+	StartTLS bool
+	TLS      bool
+}
+
+// sender is implemented by channels that deliver without HTTP.
+type sender interface {
+	Send(r request) error
+}
+
+// emailChannel mails messages over SMTP. The session hook is the recipient,
+// either a plain address or a mailto: URL.
+type emailChannel struct {
+	cfg SMTPConfig
+}
+
+func emailRecipient(hook string) (string, error) {
+	a, err := mail.ParseAddress(strings.TrimPrefix(hook, "mailto:"))
+	if err != nil {
+		return "", fmt.Errorf("invalid email recipient %q: %v", hook, err)
+	}
+	return a.Address, nil
+}
+
+func messageID(from string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	domain := "tbcpusher"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+func writeQuotedPrintable(w *multipart.Writer, contentType string, s string) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	p, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(p)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Request builds a multipart/alternative mail with a text and an HTML body.
+func (c emailChannel) Request(s Session, payload wsgo.H) (request, error) {
+	if c.cfg.Host == "" {
+		return request{}, fmt.Errorf("smtp is not configured")
+	}
+	to, err := emailRecipient(s.GetPushHook())
+	if err != nil {
+		return request{}, err
+	}
+	from, err := mail.ParseAddress(c.cfg.From)
+	if err != nil {
+		return request{}, fmt.Errorf("invalid smtp from %q: %v", c.cfg.From, err)
+	}
+	ms := payloadMessages(payload)
+	var subject string
+	var text, htm strings.Builder
+	htm.WriteString("<!DOCTYPE html><html><body>")
+	for i, m := range ms {
+		if i > 0 {
+			text.WriteString("\r\n\r\n---\r\n\r\n")
+			htm.WriteString("<hr>")
+		}
+		if m.Title != "" {
+			text.WriteString(m.Title + "\r\n\r\n")
+			htm.WriteString("<h2>" + html.EscapeString(m.Title) + "</h2>")
+		}
+		text.WriteString(m.Content)
+		htm.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(m.Content), "\n", "<br>") + "</p>")
+		if m.Author != "" {
+			text.WriteString("\r\n\r\n-- " + m.Author)
+			htm.WriteString("<p><small>" + html.EscapeString(m.Author) + "</small></p>")
+		}
+	}
+	if u, read := payloadAck(payload); u != "" {
+		text.WriteString("\r\n\r\nAcknowledge: " + u + "\r\nMark read: " + read)
+		htm.WriteString("<p><a href=\"" + html.EscapeString(u) + "\">Acknowledge</a> · <a href=\"" +
+			html.EscapeString(read) + "\">Mark read</a></p>")
+	}
+	htm.WriteString("</body></html>")
+	switch {
+	case len(ms) == 1:
+		subject = ms[0].Title
+	case len(ms) > 1:
+		subject = fmt.Sprintf("%d notifications", len(ms))
+	}
+	if len(ms) == 1 && (ms[0].Priority == PriorityCritical || ms[0].Priority == PriorityHigh) {
+		subject = "[" + strings.ToUpper(string(ms[0].Priority)) + "] " + subject
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	hs := []string{
+		"From: " + from.String(),
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + messageID(from.Address),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + w.Boundary(),
+	}
+	body.WriteString(strings.Join(hs, "\r\n") + "\r\n\r\n")
+	if err := writeQuotedPrintable(w, "text/plain; charset=utf-8", text.String()); err != nil {
+		return request{}, err
+	}
+	if err := writeQuotedPrintable(w, "text/html; charset=utf-8", htm.String()); err != nil {
+		return request{}, err
+	}
+	if err := w.Close(); err != nil {
+		return request{}, err
+	}
+	return request{
+		Method: "SMTP",
+		URL:    "mailto:" + to,
+		Header: map[string]string{"From": from.Address},
+		Body:   body.Bytes(),
+	}, nil
+}
+
+func (emailChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	return 0, false
+}
+
+// Send hands the mail built by Request to the SMTP server.
+func (c emailChannel) Send(r request) error {
+	if c.cfg.Host == "" {
+		return fmt.Errorf("smtp is not configured")
+	}
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: c.cfg.Host}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.cfg.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	client, err := smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %v", err)
+	}
+	defer client.Close()
+	if c.cfg.StartTLS && !c.cfg.TLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp: server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smtp starttls: %v", err)
+		}
+	}
+	if c.cfg.Username != "" {
+		auth := smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("smtp auth: %v", err)
+		}
+	}
+	if err := client.Mail(r.Header["From"]); err != nil {
+		return fmt.Errorf("smtp mail: %v", err)
+	}
+	if err := client.Rcpt(strings.TrimPrefix(r.URL, "mailto:")); err != nil {
+		return fmt.Errorf("smtp rcpt: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	if _, err := w.Write(r.Body); err != nil {
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp data: %v", err)
+	}
+	return client.Quit()
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// stubSMTP accepts one mail and records the commands and data it gets.
+type stubSMTP struct {
+	port     int
+	commands chan []string
+	data     chan string
+}
+
+func newStubSMTP(t *testing.T) *stubSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &stubSMTP{port: l.Addr().(*net.TCPAddr).Port, commands: make(chan []string, 1), data: make(chan string, 1)}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+		reply := func(line string) {
+			w.WriteString(line + "\r\n")
+			w.Flush()
+		}
+		var commands []string
+		defer func() { s.commands <- commands }()
+		reply("220 stub ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			commands = append(commands, line)
+			switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+			case "EHLO":
+				reply("250-stub")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 accepted")
+			case "MAIL", "RCPT":
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(l, "."))
+				}
+				s.data <- data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown")
+			}
+		}
+	}()
+	return s
+}
+
+func TestEmailSend(t *testing.T) {
+	smtp := newStubSMTP(t)
+	ch := emailChannel{cfg: SMTPConfig{Host: "127.0.0.1", Port: smtp.port, Username: "pusher", Password: "secret",
+		From: "Pusher <push@example.com>"}}
+	s := Session{stubSession{hook: "mailto:ops@example.com"}}
+	req, err := ch.Request(s, wsgo.H{
+		"message": &Message{Title: "Disk voll ✓", Content: "db1 <at> 99%\nsee dashboard", Author: "monitor",
+			Priority: PriorityHigh},
+		"ack": wsgo.H{"url": "https://push.example/delivery/ack?d=1", "read_url": "https://push.example/delivery/ack?d=1&read=true"},
+	})
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if err := ch.Send(req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	commands := <-smtp.commands
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00pusher\x00secret"))
+	for _, want := range []string{"AUTH PLAIN " + auth, "MAIL FROM:<push@example.com>", "RCPT TO:<ops@example.com>"} {
+		found := false
+		for _, c := range commands {
+			found = found || strings.HasPrefix(c, want)
+		}
+		if !found {
+			t.Errorf("no %q in %q", want, commands)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(<-smtp.data))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if raw := msg.Header.Get("Subject"); !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Errorf("subject not encoded: %q", raw)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "[HIGH] Disk voll ✓" {
+		t.Errorf("subject = %q, %v", subject, err)
+	}
+	if from := msg.Header.Get("From"); from != `"Pusher" <push@example.com>` {
+		t.Errorf("from = %q", from)
+	}
+	if to := msg.Header.Get("To"); to != "ops@example.com" {
+		t.Errorf("to = %q", to)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("message id = %q", id)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type = %v, %v", mediaType, err)
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reader undoes the quoted-printable encoding
+		b, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[strings.Split(p.Header.Get("Content-Type"), ";")[0]] = strings.ReplaceAll(string(b), "\r\n", "\n")
+	}
+	text, htm := parts["text/plain"], parts["text/html"]
+	for _, want := range []string{"Disk voll ✓", "db1 <at> 99%\nsee dashboard", "-- monitor",
+		"Acknowledge: https://push.example/delivery/ack?d=1"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text has no %q:\n%s", want, text)
+		}
+	}
+	for _, want := range []string{"<h2>Disk voll ✓</h2>", "db1 &lt;at&gt; 99%<br>see dashboard",
+		`<a href="https://push.example/delivery/ack?d=1&amp;read=true">Mark read</a>`} {
+		if !strings.Contains(htm, want) {
+			t.Errorf("html has no %q:\n%s", want, htm)
+		}
+	}
+}
+
+func TestEmailRequestErrors(t *testing.T) {
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: 25, From: "push@example.com"}
+	for _, tt := range []struct {
+		name string
+		ch   emailChannel
+		hook string
+	}{
+		{"not configured", emailChannel{}, "ops@example.com"},
+		{"bad recipient", emailChannel{cfg: cfg}, "mailto:not an address"},
+		{"bad from", emailChannel{cfg: SMTPConfig{Host: "127.0.0.1", From: "@"}}, "ops@example.com"},
+	} {
+		if _, err := tt.ch.Request(Session{stubSession{hook: tt.hook}}, wsgo.H{"message": &Message{Title: "x"}}); err == nil {
+			t.Errorf("%v: no error", tt.name)
+		}
+	}
+	if err := (emailChannel{cfg: SMTPConfig{Host: "127.0.0.1", Port: 1}}).Send(request{}); err == nil ||
+		!strings.Contains(err.Error(), "smtp dial") {
+		t.Errorf("Send to a closed port = %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// checkEscalationPolicy validates a policy; an empty timeout removes it.
+func (s *Server) checkEscalationPolicy(p database.EscalationPolicy) error {
+	if p.Timeout == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid escalation timeout: %v", p.Timeout)
+	}
+	if p.Repeat < 0 {
+		return fmt.Errorf("invalid escalation repeat: %v", p.Repeat)
+	}
+	if p.FallbackGroup != "" && p.FallbackSession != "" {
+		return fmt.Errorf("fallback is a group or a session, not both")
+	}
+	for _, g := range append(p.Tiers, p.FallbackGroup) {
+		if g == "" {
+			continue
+		}
+		if _, err := s.db.GetGroupByID(g); err != nil {
+			return err
+		}
+	}
+	if p.FallbackSession != "" {
+		if _, err := s.db.GetSessionByID(p.FallbackSession); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escalationTarget returns the group or session step n of an escalation of
+// group goes to, or false after the last step.
+func escalationTarget(p database.EscalationPolicy, group string, n int) (string, string, bool) {
+	repeat := p.Repeat
+	if repeat == 0 {
+		repeat = 1
+	}
+	tiers := p.Tiers
+	if len(tiers) == 0 {
+		tiers = []string{group}
+	}
+	if n < repeat*len(tiers) {
+		return tiers[n%len(tiers)], "", true
+	}
+	if n == repeat*len(tiers) && (p.FallbackGroup != "" || p.FallbackSession != "") {
+		return p.FallbackGroup, p.FallbackSession, true
+	}
+	return "", "", false
+}
+
+// startEscalation watches the deliveries of a critical group push made at t,
+// following the group escalation policy if it has one.
+func (s *Server) startEscalation(g database.Group, m *Message, deliveries []string, t time.Time) {
+	p := g.GetEscalationPolicy()
+	if p.Timeout == "" {
+		return
+	}
+	timeout, err := time.ParseDuration(p.Timeout)
+	if err != nil {
+		fmt.Printf("escalation: group %v: %v\n", g.GetID(), err)
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		fmt.Printf("escalation: %v\n", err)
+		return
+	}
+	now := time.Now()
+	e := database.Escalation{Group: g.GetID(), Policy: p, Message: string(b), Deliveries: deliveries,
+		Status: database.EscalationActive, Next: t.Add(timeout), Created: now, Updated: now}
+	if e.ID, err = s.db.NewEscalation(e); err != nil {
+		fmt.Printf("escalation: %v\n", err)
+		return
+	}
+	s.scheduleEscalation(e)
+}
+
+// scheduleEscalation adds the job running the next step and saves the state,
+// dropping the job again if the escalation has ended meanwhile.
+func (s *Server) scheduleEscalation(e database.Escalation) {
+	entry := s.scheduler.AddJob(&EscalationStepJob{escalation: e.ID, srv: s}, NewOneTimeSchedule(e.Next))
+	e.Entry = entry.(database.Entry).GetID()
+	active, err := s.db.UpdateActiveEscalation(e)
+	if err != nil {
+		fmt.Printf("escalation %v: %v\n", e.ID, err)
+	}
+	if !active {
+		s.scheduler.Remove(entry)
+	}
+}
+
+// EscalationStepJob runs the next step of an escalation unless one of its
+// deliveries has been acknowledged.
+type EscalationStepJob struct {
+	escalation string
+	srv        *Server
+}
+
+func (j *EscalationStepJob) bind(s *Server) {
+	j.srv = s
+}
+
+func (j *EscalationStepJob) Run() {
+	if j.srv == nil {
+		return
+	}
+	if err := j.srv.escalate(j.escalation); err != nil {
+		fmt.Printf("escalation %v: %v\n", j.escalation, err)
+	}
+}
+
+func (s *Server) escalate(id string) error {
+	e, err := s.db.GetEscalationByID(id)
+	if err != nil || e.Status != database.EscalationActive {
+		return err
+	}
+	now := time.Now()
+	e.Updated, e.Entry = now, ""
+	acked, err := s.db.AnyAcked(e.Deliveries)
+	if err != nil {
+		return err
+	}
+	gid, sid, ok := escalationTarget(e.Policy, e.Group, e.Step)
+	if acked || !ok {
+		e.Status, e.Next = database.EscalationAcked, time.Time{}
+		if !acked {
+			e.Status = database.EscalationExhausted
+		}
+		_, err := s.db.UpdateActiveEscalation(e)
+		return err
+	}
+	var m Message
+	if err := json.Unmarshal([]byte(e.Message), &m); err != nil {
+		return err
+	}
+	// tiers get the message whatever their topics
+	m.Priority, m.Topic, m.escalation = PriorityCritical, "", true
+	m.Title = fmt.Sprintf("[Escalation %d] %s", e.Step+1, m.Title)
+	if gid != "" {
+		g, err := s.db.GetGroupByID(gid)
+		if err == nil {
+			var resps []pushResp
+			resps, err = Group{g}.Push(&m, s)
+			for _, r := range resps {
+				if r.Delivery != "" {
+					e.Deliveries = append(e.Deliveries, r.Delivery)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("escalation %v: push to group %v: %v\n", id, gid, err)
+		}
+	} else {
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			r := Session{session}.Push(&m, s)
+			if r.Delivery != "" {
+				e.Deliveries = append(e.Deliveries, r.Delivery)
+			}
+		}
+		if err != nil {
+			fmt.Printf("escalation %v: push to session %v: %v\n", id, sid, err)
+		}
+	}
+	e.Step++
+	timeout, _ := time.ParseDuration(e.Policy.Timeout)
+	e.Next = now.Add(timeout)
+	s.scheduleEscalation(e)
+	return nil
+}
+
+func (j *EscalationStepJob) Save() (bson.M, error) {
+	return bson.M{"escalation": j.escalation}, nil
+}
+
+func (j *EscalationStepJob) Load(m bson.M) error {
+	id, ok := m["escalation"].(string)
+	if !ok {
+		return fmt.Errorf("missing escalation")
+	}
+	j.escalation = id
+	return nil
+}
+
+func (j *EscalationStepJob) GetType() string {
+	return "EscalationStepJob"
+}
+
+func (j *EscalationStepJob) IsType(t string) bool {
+	return t == "EscalationStepJob"
+}
+
+func escalationWsgoH(e database.Escalation) wsgo.H {
+	r := wsgo.H{"id": e.ID, "group": e.Group, "policy": e.Policy, "deliveries": e.Deliveries, "step": e.Step,
+		"status": e.Status, "created": e.Created, "updated": e.Updated}
+	var m Message
+	if json.Unmarshal([]byte(e.Message), &m) == nil {
+		r["message"] = m
+	}
+	if !e.Next.IsZero() {
+		r["next"] = e.Next
+	}
+	return r
+}
+
+func (s *Server) handleEscalations(r *wsgo.ServerMux) {
+	// set the escalation policy of a group; an empty timeout removes it
+	// group={groupid}&timeout={15m}&tiers=[groupid]&repeat={}&fallback_group={}&fallback_session={}
+	r.Handle(s.prefix+"/group/setescalation", requireString("group"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		gid := ps["group"]
+		p := database.EscalationPolicy{Timeout: ps["timeout"], FallbackGroup: ps["fallback_group"],
+			FallbackSession: ps["fallback_session"]}
+		g, err := s.db.GetGroupByID(gid)
+		if err == nil {
+			err = bindParam(c, "tiers", &p.Tiers)
+		}
+		if err == nil {
+			p.Repeat, _, err = intParam(c, "repeat")
+		}
+		if err == nil {
+			err = s.checkEscalationPolicy(p)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if p.Timeout == "" {
+			p = database.EscalationPolicy{}
+		}
+		if err := g.SetEscalationPolicy(p); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v set escalation: %v", gid, err)
+			return
+		}
+	})
+	// latest escalations, of a group and in a status if given
+	// group={groupid}&status={active|acked|exhausted|cancelled}&limit={}
+	r.Handle(s.prefix+"/escalation/list", func(c *wsgo.Context) {
+		ps := c.StringParams()
+		limit, _, err := intParam(c, "limit")
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if limit <= 0 || limit > database.MaxListLimit {
+			limit = database.DefaultListLimit
+		}
+		es, err := s.db.GetEscalations(ps["group"], ps["status"], limit)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("GetEscalations: %v", err)
+			return
+		}
+		ret := []wsgo.H{}
+		for _, e := range es {
+			ret = append(ret, escalationWsgoH(e))
+		}
+		c.Json(http.StatusOK, ret)
+	})
+	// escalation={escalationid}
+	r.Handle(s.prefix+"/escalation/check", requireString("escalation"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("escalation")
+		e, err := s.db.GetEscalationByID(id)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, escalationWsgoH(e))
+	})
+	// stop an active escalation
+	// escalation={escalationid}
+	r.Handle(s.prefix+"/escalation/cancel", requireString("escalation"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("escalation")
+		e, err := s.db.GetEscalationByID(id)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		entry := e.Entry
+		e.Status, e.Next, e.Entry, e.Updated = database.EscalationCancelled, time.Time{}, "", time.Now()
+		active, err := s.db.UpdateActiveEscalation(e)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("escalation %v cancel: %v", id, err)
+			return
+		}
+		if !active {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: escalation %v is not active", id)
+			return
+		}
+		// a step running meanwhile drops the job it schedules by itself
+		if entry != "" {
+			if err := s.removeEntry(entry); err != nil {
+				c.Log("escalation %v: %v", id, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatTemplate = "template"
+	FormatForm     = "form"
+	FormatText     = "text"
+)
+
+const defaultTextFormat = `{{with .message}}{{.Title}}
+{{.Content}}{{end}}{{range .messages}}{{.Title}}
+{{.Content}}
+{{end}}`
+
+var defaultFormFields = map[string]string{
+	"author":   "{{.message.Author}}",
+	"title":    "{{.message.Title}}",
+	"content":  "{{.message.Content}}",
+	"priority": "{{.message.Priority}}",
+}
+
+var formatFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// request is an outgoing delivery, kept by PushToSessionJob until it is sent.
+type request struct {
+	Session string
+	Channel string
+	Method  string
+	URL     string
+	Header  map[string]string
+	Body    []byte
+}
+
+// do sends the request with client and reads up to 64 KiB of the response body.
+func (r request) do(client *http.Client) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(r.Method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range r.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return resp, body, err
+}
+
+func checkFormat(f database.Format) error {
+	switch f.Method {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method: %s", f.Method)
+	}
+	switch f.Type {
+	case "", FormatJSON:
+	case FormatTemplate, FormatText:
+		if f.Type == FormatTemplate && f.Body == "" {
+			return fmt.Errorf("format %s needs a body", f.Type)
+		}
+		if _, err := template.New("body").Funcs(formatFuncs).Parse(f.Body); err != nil {
+			return fmt.Errorf("format body: %v", err)
+		}
+	case FormatForm:
+		for k, v := range f.Fields {
+			if _, err := template.New(k).Funcs(formatFuncs).Parse(v); err != nil {
+				return fmt.Errorf("format field %v: %v", k, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format: %s", f.Type)
+	}
+	for k := range f.Headers {
+		if k == "" || strings.ContainsAny(k, " :\r\n") {
+			return fmt.Errorf("invalid header name: %q", k)
+		}
+	}
+	return nil
+}
+
+func execFormat(name string, src string, data any) (string, error) {
+	t, err := template.New(name).Funcs(formatFuncs).Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("format %v: %v", name, err)
+	}
+	return b.String(), nil
+}
+
+// formatRequest encodes payload in the session's format.
+func (s Session) formatRequest(payload wsgo.H) (request, error) {
+	f := s.GetFormat()
+	r := request{Method: f.Method, URL: s.GetPushHook(), Header: map[string]string{}}
+	if r.Method == "" {
+		r.Method = http.MethodPost
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return r, err
+	}
+	if f.Type == "" || f.Type == FormatJSON {
+		r.Body = raw
+		r.Header["Content-Type"] = "application/json"
+	} else {
+		// templates see the payload the way the default JSON body shows it
+		var data any
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return r, err
+		}
+		switch f.Type {
+		case FormatTemplate:
+			body, err := execFormat("body", f.Body, data)
+			if err != nil {
+				return r, err
+			}
+			r.Body = []byte(body)
+			r.Header["Content-Type"] = "application/json"
+		case FormatText:
+			src := f.Body
+			if src == "" {
+				src = defaultTextFormat
+			}
+			body, err := execFormat("body", src, data)
+			if err != nil {
+				return r, err
+			}
+			r.Body = []byte(body)
+			r.Header["Content-Type"] = "text/plain; charset=utf-8"
+		case FormatForm:
+			fields := f.Fields
+			if len(fields) == 0 {
+				fields = defaultFormFields
+			}
+			form := url.Values{}
+			for k, src := range fields {
+				v, err := execFormat(k, src, data)
+				if err != nil {
+					return r, err
+				}
+				form.Set(k, v)
+			}
+			if r.Method == http.MethodGet {
+				u, err := url.Parse(r.URL)
+				if err != nil {
+					return r, err
+				}
+				q := u.Query()
+				for k, v := range form {
+					q[k] = v
+				}
+				u.RawQuery = q.Encode()
+				r.URL = u.String()
+			} else {
+				r.Body = []byte(form.Encode())
+				r.Header["Content-Type"] = "application/x-www-form-urlencoded"
+			}
+		default:
+			return r, fmt.Errorf("unknown format: %s", f.Type)
+		}
+	}
+	for k, v := range f.Headers {
+		r.Header[k] = v
+	}
+	return r, nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// maxGroupDepth bounds walks up the group tree.
+const maxGroupDepth = 64
+
+// checkParent makes sure moving g under parent keeps the tree acyclic.
+func (s *Server) checkParent(g database.Group, parent string) error {
+	for i, id := 0, parent; id != ""; i++ {
+		if id == g.GetID() {
+			return fmt.Errorf("group %v cannot be moved below itself", g.GetID())
+		}
+		if i == maxGroupDepth {
+			return fmt.Errorf("group tree deeper than %v", maxGroupDepth)
+		}
+		p, err := s.db.GetGroupByID(id)
+		if err != nil {
+			return err
+		}
+		id = p.GetParentID()
+	}
+	return nil
+}
+
+// tree describes g with its subgroups nested as children.
+func (g Group) tree(depth int) (wsgo.H, error) {
+	r := g.WsgoH()
+	children := []wsgo.H{}
+	if depth < maxGroupDepth {
+		cs, err := g.GetChildren()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			t, err := Group{c}.tree(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, t)
+		}
+	}
+	r["children"] = children
+	return r, nil
+}
+
+func (s *Server) handleGroupTree(r *wsgo.ServerMux) {
+	// move a group below another one; an empty parent makes it a top level group
+	// group={groupid}&parent={groupid}
+	r.Handle(s.prefix+"/group/setparent", requireString("group", "parent"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		gid, parent := ps["group"], ps["parent"]
+		g, err := s.db.GetGroupByID(gid)
+		if err == nil {
+			err = s.checkParent(g, parent)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := g.SetParentID(parent); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v set parent %v: %v", gid, parent, err)
+			return
+		}
+	})
+	// group={groupid}
+	r.Handle(s.prefix+"/group/tree", requireString("group"), func(c *wsgo.Context) {
+		gid, _ := c.StringParam("group")
+		g, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		t, err := Group{g}.tree(0)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v tree: %v", gid, err)
+			return
+		}
+		c.Json(http.StatusOK, t)
+	})
+	// sessions a push to the group reaches, including those of its descendants
+	// group={groupid}&topic={}&tags={}
+	r.Handle(s.prefix+"/group/members", requireString("group"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		gid := ps["group"]
+		g, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		tags, err := parseTagExpr(ps["tags"])
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		sessions, err := g.FindSessions(ps["topic"], tags)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v members: %v", gid, err)
+			return
+		}
+		ret := []wsgo.H{}
+		for _, session := range sessions {
+			ret = append(ret, Session{session}.WsgoH())
+		}
+		c.Json(http.StatusOK, ret)
+	})
+	// session={sessionid}&group={groupid}
+	r.Handle(s.prefix+"/session/addgroup", requireString("session", "group"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, gid := ps["session"], ps["group"]
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			_, err = s.db.GetGroupByID(gid)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.AddGroup(gid); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v add group %v: %v", sid, gid, err)
+			return
+		}
+		s.audit(c, sid, AuditAddGroup, "", gid)
+	})
+	// session={sessionid}&group={groupid}
+	r.Handle(s.prefix+"/session/removegroup", requireString("session", "group"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, gid := ps["session"], ps["group"]
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.RemoveGroup(gid); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v remove group %v: %v", sid, gid, err)
+			return
+		}
+		s.audit(c, sid, AuditRemoveGroup, gid, "")
+	})
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	AuditMove        = "move"
+	AuditDetach      = "detach"
+	AuditSetHook     = "sethook"
+	AuditAddGroup    = "addgroup"
+	AuditRemoveGroup = "removegroup"
+)
+
+// audit records a session change made by the request, logging failures.
+func (s *Server) audit(c *wsgo.Context, session string, action string, from string, to string) {
+	a := database.Audit{Time: time.Now(), Session: session, Action: action, From: from, To: to,
+		Remote: c.GetRequest().RemoteAddr}
+	if err := s.db.NewAudit(a); err != nil {
+		c.Log("audit %v %v: %v", action, session, err)
+	}
+}
+
+// hookSession is a session seen with another hook.
+type hookSession struct {
+	database.Session
+	hook string
+}
+
+func (h hookSession) GetPushHook() string {
+	return h.hook
+}
+
+// notify sends m to hook through the session channel, bypassing quiet hours,
+// digests and retries.
+func (s *Server) notify(session database.Session, hook string, m *Message) error {
+	hs := Session{hookSession{session, hook}}
+	r, err := hs.request(s, wsgo.H{"session": hs.WsgoH(), "message": m})
+	if err != nil {
+		return err
+	}
+	if snd, ok := s.channel(r.Channel).(sender); ok {
+		return snd.Send(r)
+	}
+	client, err := s.sessionClient(session)
+	if err != nil {
+		return err
+	}
+	resp, _, err := r.do(client)
+	if err != nil {
+		return err
+	}
+	if !delivered(resp) {
+		return fmt.Errorf("hook responded %v", resp.Status)
+	}
+	return nil
+}
+
+func (s *Server) handleHooks(r *wsgo.ServerMux) {
+	// move a session to another group
+	// session={sessionid}&group={groupid}
+	r.Handle(s.prefix+"/session/move", requireString("session", "group"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, gid := ps["session"], ps["group"]
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			_, err = s.db.GetGroupByID(gid)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		from := session.GetGroupID()
+		if err := session.SetGroupID(gid); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v move to %v: %v", sid, gid, err)
+			return
+		}
+		s.audit(c, sid, AuditMove, from, gid)
+	})
+	// take a session out of its group
+	// session={sessionid}
+	r.Handle(s.prefix+"/session/detach", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		from := session.GetGroupID()
+		if from == "" {
+			return
+		}
+		if err := session.RemoveGroup(from); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v detach: %v", sid, err)
+			return
+		}
+		s.audit(c, sid, AuditDetach, from, "")
+	})
+	// change the session hook; with verify, or when hooks must be verified, the session keeps
+	// its current hook until the new one confirms the challenge
+	// session={sessionid}&hook={callbackurl}&verify={bool}
+	r.Handle(s.prefix+"/session/sethook", requireString("session", "hook"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, hook := ps["session"], ps["hook"]
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil && hook == "" {
+			err = fmt.Errorf("empty hook")
+		}
+		if err == nil && session.GetChannel() == ChannelEmail {
+			_, err = emailRecipient(hook)
+		}
+		if err == nil {
+			err = s.checkHook(session.GetChannel(), hook)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if s.verifyHooks || boolParam(c, "verify") {
+			state, err := s.challenge(c, session, hook, session.GetVerification().State == database.VerificationPending)
+			if err != nil {
+				c.String(http.StatusFailedDependency, http.StatusText(http.StatusFailedDependency))
+				c.Log("session %v verify hook: %v", sid, err)
+				return
+			}
+			c.Json(http.StatusAccepted, wsgo.H{"verification": state})
+			return
+		}
+		from := session.GetPushHook()
+		if err := session.SetPushHook(hook); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set hook: %v", sid, err)
+			return
+		}
+		s.audit(c, sid, AuditSetHook, from, hook)
+	})
+	// latest changes to a session, newest first
+	// session={sessionid}&limit={}
+	r.Handle(s.prefix+"/session/audit", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		limit, _, err := intParam(c, "limit")
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if limit <= 0 || limit > database.MaxListLimit {
+			limit = database.DefaultListLimit
+		}
+		l, err := s.db.GetAudit(sid, limit)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v audit: %v", sid, err)
+			return
+		}
+		c.Json(http.StatusOK, l)
+	})
+}
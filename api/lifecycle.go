@@ -0,0 +1,162 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	GroupSessionsOrphan = "orphan"
+	GroupSessionsDelete = "delete"
+)
+
+// DefaultRestoreWindow is how long soft deleted sessions and groups can be restored.
+const DefaultRestoreWindow = 7 * 24 * time.Hour
+
+// SetRestoreWindow sets how long soft deleted sessions and groups are kept.
+func (s *Server) SetRestoreWindow(d time.Duration) {
+	s.restoreWindow = d
+}
+
+// purgeGroup removes a group for good, and with deleteSessions its own
+// sessions, hidden ones included. Sessions only added to it stay.
+func (s *Server) purgeGroup(id string, deleteSessions bool) error {
+	if deleteSessions {
+		g, err := s.db.GetGroupByID(id)
+		if err != nil {
+			return err
+		}
+		sessions, err := g.GetOwnSessions()
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if err := s.db.PurgeSession(session.GetID()); err != nil {
+				return err
+			}
+		}
+	}
+	return s.db.PurgeGroup(id)
+}
+
+// purge removes what was soft deleted before the restore window.
+func (s *Server) purge() error {
+	sessions, groups, err := s.db.GetDeletedBefore(time.Now().Add(-s.restoreWindow))
+	if err != nil {
+		return err
+	}
+	for _, id := range sessions {
+		if err := s.db.PurgeSession(id); err != nil {
+			return fmt.Errorf("purge session %v: %v", id, err)
+		}
+	}
+	for _, id := range groups {
+		if err := s.db.PurgeGroup(id); err != nil {
+			return fmt.Errorf("purge group %v: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) purgeLoop() {
+	for {
+		if err := s.purge(); err != nil {
+			fmt.Printf("purge: %v\n", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (s *Server) handleLifecycle(r *wsgo.ServerMux) {
+	// session={sessionid}
+	r.Handle(s.prefix+"/session/unhide", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.Unhide(); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("unhide session %v: %v", sid, err)
+			return
+		}
+	})
+	// delete a session; it can be restored within the restore window unless hard is set,
+	// which also removes its scheduled pushes and delivery history right away
+	// session={sessionid}&hard={bool}
+	r.Handle(s.prefix+"/session/delete", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if boolParam(c, "hard") {
+			err = s.db.PurgeSession(sid)
+		} else {
+			err = session.SoftDelete(time.Now())
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("delete session %v: %v", sid, err)
+			return
+		}
+	})
+	// session={sessionid}
+	r.Handle(s.prefix+"/session/restore", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		if err := s.db.RestoreSession(sid); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+	})
+	// delete a group, orphaning or deleting its own sessions; subgroups move up on purge
+	// group={groupid}&sessions={orphan|delete}&hard={bool}
+	r.Handle(s.prefix+"/group/delete", requireString("group"), func(c *wsgo.Context) {
+		gid, _ := c.StringParam("group")
+		mode := c.DefaultStringParam("sessions", GroupSessionsOrphan)
+		if mode != GroupSessionsOrphan && mode != GroupSessionsDelete {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: unknown sessions mode: %v", mode)
+			return
+		}
+		g, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		switch {
+		case boolParam(c, "hard"):
+			err = s.purgeGroup(gid, mode == GroupSessionsDelete)
+		case mode == GroupSessionsOrphan:
+			if err = g.DetachSessions(); err == nil {
+				err = g.SoftDelete(time.Now(), false)
+			}
+		default:
+			err = g.SoftDelete(time.Now(), true)
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("delete group %v: %v", gid, err)
+			return
+		}
+	})
+	// restore a group with the sessions deleted along with it
+	// group={groupid}
+	r.Handle(s.prefix+"/group/restore", requireString("group"), func(c *wsgo.Context) {
+		gid, _ := c.StringParam("group")
+		if err := s.db.RestoreGroup(gid); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// listOptions reads the paging, sorting and filter params shared by the list endpoints.
+func listOptions(c *wsgo.Context) (database.ListOptions, error) {
+	ps := c.StringParams()
+	o := database.ListOptions{Cursor: ps["cursor"], Sort: ps["sort"], Group: ps["group"], Parent: ps["parent"],
+		HookHost: ps["host"]}
+	n, _, err := intParam(c, "limit")
+	if err != nil {
+		return o, err
+	}
+	o.Limit = n
+	if v, ok := c.Param("hidden"); ok {
+		var b bool
+		switch t := v.(type) {
+		case bool:
+			b = t
+		case string:
+			if b, err = strconv.ParseBool(t); err != nil {
+				return o, fmt.Errorf("invalid hidden: %v", err)
+			}
+		default:
+			return o, fmt.Errorf("invalid hidden: %v", v)
+		}
+		o.Hidden = &b
+	}
+	if err := bindParam(c, "data", &o.Data); err != nil {
+		return o, fmt.Errorf("invalid data: %v", err)
+	}
+	return o, nil
+}
+
+func (s *Server) handleList(r *wsgo.ServerMux) {
+	// list groups page by page; pass the returned next as cursor for the following page
+	// limit={}&cursor={}&sort={id|-id}&parent={groupid}&data={"field": value}
+	r.Handle(s.prefix+"/group/list", func(c *wsgo.Context) {
+		o, err := listOptions(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		groups, next, err := s.db.ListGroups(o)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		items := []wsgo.H{}
+		for _, g := range groups {
+			items = append(items, Group{g}.WsgoH())
+		}
+		c.Json(http.StatusOK, wsgo.H{"items": items, "next": next})
+	})
+	// list sessions page by page; pass the returned next as cursor for the following page
+	// limit={}&cursor={}&sort={id|hook|host, - for descending}&hidden={bool}&group={groupid}&host={hook host}&data={"field": value}
+	r.Handle(s.prefix+"/session/list", func(c *wsgo.Context) {
+		o, err := listOptions(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		sessions, next, err := s.db.ListSessions(o)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		items := []wsgo.H{}
+		for _, session := range sessions {
+			items = append(items, Session{session}.WsgoH())
+		}
+		c.Json(http.StatusOK, wsgo.H{"items": items, "next": next})
+	})
+}
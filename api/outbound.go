@@ -0,0 +1,229 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+)
+
+// ErrBlocked is returned for outgoing requests the outbound policy forbids.
+// They are not retried.
+var ErrBlocked = errors.New("blocked by outbound policy")
+
+// OutboundPolicy restricts where deliveries may go. Hosts are matched by name,
+// "*.example.com" also matching subdomains. Addresses are checked after DNS
+// resolution when connecting, so names rebinding to forbidden addresses are
+// caught too. Unless AllowPrivate is set, loopback, private, link-local and
+// other special purpose addresses are denied; AllowCIDRs overrides this and
+// DenyCIDRs.
+type OutboundPolicy struct {
+	Schemes      []string
+	AllowHosts   []string
+	DenyHosts    []string
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	AllowPrivate bool
+	MaxRedirects int
+}
+
+// DefaultOutboundPolicy allows http and https to public addresses with up to
+// 5 redirects.
+func DefaultOutboundPolicy() OutboundPolicy {
+	return OutboundPolicy{Schemes: []string{"http", "https"}, MaxRedirects: 5}
+}
+
+// defaultClient sends the requests of jobs not bound to a server.
+var defaultClient = func() *http.Client {
+	o, _ := newOutbound(DefaultOutboundPolicy())
+	c, _ := newClient(o, DefaultClientConfig(), database.ClientOptions{})
+	return c
+}()
+
+// specialNets are reserved ranges not covered by the net.IP predicates.
+var specialNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "64:ff9b::/96", "2001:db8::/32")
+
+func parseCIDRs(l ...string) []*net.IPNet {
+	nets, err := cidrs(l)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// cidrs parses CIDRs, taking plain addresses as single address ranges.
+func cidrs(l []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range l {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches tells if host matches one of the patterns.
+func hostMatches(patterns []string, host string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == host || strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// outbound is a compiled OutboundPolicy.
+type outbound struct {
+	OutboundPolicy
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newOutbound(p OutboundPolicy) (*outbound, error) {
+	o := &outbound{OutboundPolicy: p}
+	var err error
+	if o.allow, err = cidrs(p.AllowCIDRs); err != nil {
+		return nil, fmt.Errorf("allow cidrs: %v", err)
+	}
+	if o.deny, err = cidrs(p.DenyCIDRs); err != nil {
+		return nil, fmt.Errorf("deny cidrs: %v", err)
+	}
+	return o, nil
+}
+
+// checkURL checks the scheme and host of u, and the address if the host is one.
+func (o *outbound) checkURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	ok := len(o.Schemes) == 0
+	for _, s := range o.Schemes {
+		ok = ok || strings.EqualFold(s, scheme)
+	}
+	if !ok {
+		return fmt.Errorf("%w: scheme %q", ErrBlocked, u.Scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: no host", ErrBlocked)
+	}
+	if hostMatches(o.DenyHosts, host) || len(o.AllowHosts) > 0 && !hostMatches(o.AllowHosts, host) {
+		return fmt.Errorf("%w: host %s", ErrBlocked, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return o.checkIP(ip)
+	}
+	return nil
+}
+
+func (o *outbound) checkIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if containsIP(o.allow, ip) {
+		return nil
+	}
+	if containsIP(o.deny, ip) {
+		return fmt.Errorf("%w: address %v", ErrBlocked, ip)
+	}
+	if !o.AllowPrivate && (ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || containsIP(specialNets, ip)) {
+		return fmt.Errorf("%w: address %v", ErrBlocked, ip)
+	}
+	return nil
+}
+
+// control checks the address a connection is about to be made to, after
+// name resolution.
+func (o *outbound) control(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", ErrBlocked, address)
+	}
+	return o.checkIP(ip)
+}
+
+// policyTransport checks every request, redirects included, before sending
+// it. With resolve, the addresses of the host are checked too.
+type policyTransport struct {
+	o       *outbound
+	base    http.RoundTripper
+	resolve bool
+}
+
+func (t policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.o.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	if host := req.URL.Hostname(); t.resolve && net.ParseIP(host) == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if err := t.o.checkIP(a.IP); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// SetOutboundPolicy sets the policy all deliveries are checked against.
+func (s *Server) SetOutboundPolicy(p OutboundPolicy) error {
+	o, err := newOutbound(p)
+	if err != nil {
+		return err
+	}
+	s.outbound = o
+	return s.SetClientConfig(s.clientCfg)
+}
+
+// checkHook rejects hooks the outbound policy would block, for channels
+// sending to the hook URL.
+func (s *Server) checkHook(channel string, hook string) error {
+	if channel == ChannelTelegram || channel == ChannelEmail {
+		return nil
+	}
+	u, err := url.Parse(hook)
+	if err != nil {
+		return err
+	}
+	return s.outbound.checkURL(u)
+}
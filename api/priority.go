@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Priority of a message. It orders the delivery queue, decides how hard failed
+// deliveries are retried and whether quiet hours are bypassed.
+type Priority string
+
+const (
+	PriorityLow      Priority = "low"
+	PriorityNormal   Priority = "normal"
+	PriorityHigh     Priority = "high"
+	PriorityCritical Priority = "critical"
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityLow, PriorityNormal, PriorityHigh, PriorityCritical:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown priority: %s", s)
+}
+
+// Level maps the priority to an integer, higher is more urgent.
+func (p Priority) Level() int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityHigh:
+		return 2
+	case PriorityCritical:
+		return 3
+	}
+	return 1
+}
+
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+var retryPolicies = map[Priority]retryPolicy{
+	PriorityLow:      {attempts: 0},
+	PriorityNormal:   {attempts: 3, backoff: time.Minute},
+	PriorityHigh:     {attempts: 5, backoff: time.Second * 30},
+	PriorityCritical: {attempts: 10, backoff: time.Second * 10},
+}
+
+const maxRetryDelay = time.Hour
+
+// raised returns the next higher priority.
+func (p Priority) raised() Priority {
+	switch p {
+	case PriorityLow:
+		return PriorityNormal
+	case PriorityNormal:
+		return PriorityHigh
+	}
+	return PriorityCritical
+}
+
+// retryDelay returns how long to wait before the given retry attempt (starting
+// at 1), or false if the priority allows no more attempts.
+func (p Priority) retryDelay(attempt int) (time.Duration, bool) {
+	rp, ok := retryPolicies[p]
+	if !ok {
+		rp = retryPolicies[PriorityNormal]
+	}
+	if attempt > rp.attempts {
+		return 0, false
+	}
+	d := rp.backoff
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d, true
+}
+
+// bypassesQuiet reports whether the priority is delivered during quiet hours.
+func (p Priority) bypassesQuiet() bool {
+	return p == PriorityCritical
+}
+
+// dropsInQuiet reports whether the priority is dropped during quiet hours
+// regardless of the session's quiet action.
+func (p Priority) dropsInQuiet() bool {
+	return p == PriorityLow
+}
+
+func delivered(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
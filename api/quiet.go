@@ -0,0 +1,105 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+)
+
+var (
+	ErrDeferred = errors.New("deferred by quiet hours")
+	ErrDropped  = errors.New("dropped by quiet hours")
+)
+
+const (
+	QuietDefer = "defer"
+	QuietDrop  = "drop"
+)
+
+// parseClock parses "15:04" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock %q: %v", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func checkQuietHours(q database.QuietHours) error {
+	switch q.Action {
+	case "", QuietDefer, QuietDrop:
+	default:
+		return fmt.Errorf("unknown quiet action: %s", q.Action)
+	}
+	for _, w := range q.Windows {
+		start, err := parseClock(w.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("empty quiet window %s-%s", w.Start, w.End)
+		}
+	}
+	return nil
+}
+
+// windowEnd returns the end of w if t falls inside it, or the zero time.
+func windowEnd(w database.QuietWindow, t time.Time) time.Time {
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil || start == end {
+		return time.Time{}
+	}
+	m := t.Hour()*60 + t.Minute()
+	// built from the wall clock, as days with a DST change are not 24 hours
+	at := func(d, min int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+d, min/60, min%60, 0, 0, t.Location())
+	}
+	switch {
+	case start < end && m >= start && m < end:
+		return at(0, end)
+	case start > end && m >= start:
+		return at(1, end)
+	case start > end && m < end:
+		return at(0, end)
+	}
+	return time.Time{}
+}
+
+// quietUntil returns when the quiet hours containing t are over, or the zero
+// time if t is not inside any window. Adjacent windows are chained.
+func quietUntil(q database.QuietHours, t time.Time) time.Time {
+	until := time.Time{}
+	for i := 0; i <= len(q.Windows); i++ {
+		moved := false
+		for _, w := range q.Windows {
+			if e := windowEnd(w, t); !e.IsZero() {
+				t, until, moved = e, e, true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return until
+}
+
+func (s Session) location() *time.Location {
+	if tz := s.GetTimezone(); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// quietUntil returns the end of the session's quiet hours around t, or the zero time.
+func (s Session) quietUntil(t time.Time) time.Time {
+	return quietUntil(s.GetQuietHours(), t.In(s.location()))
+}
@@ -0,0 +1,472 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/scheduler"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// DefaultNextRuns is how many upcoming runs recurring pushes show.
+	DefaultNextRuns = 5
+	MaxNextRuns     = 100
+)
+
+// parseInterval reads a recurring interval, a duration or seconds.
+func parseInterval(v string) (time.Duration, error) {
+	every, err := time.ParseDuration(v)
+	if err != nil {
+		sec, err2 := strconv.ParseInt(v, 10, 64)
+		if err2 != nil {
+			return 0, fmt.Errorf("invalid interval: %v", err)
+		}
+		every = time.Duration(sec) * time.Second
+	}
+	if every < time.Minute {
+		return 0, fmt.Errorf("interval must be at least a minute")
+	}
+	return every, nil
+}
+
+// timeParam reads an optional time in any of the formats of parseTime.
+func timeParam(ps map[string]string, name string, now time.Time, loc *time.Location) (time.Time, error) {
+	v, ok := ps[name]
+	if !ok {
+		return time.Time{}, nil
+	}
+	t, err := parseTime(v, now, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %v: %v", name, err)
+	}
+	return t, nil
+}
+
+// recurringSchedule returns the schedule of r, from its start until r.Until.
+func recurringSchedule(r database.Recurring) (*RecurringSchedule, error) {
+	s := &RecurringSchedule{Start: r.Start, Until: r.Until}
+	if r.Cron != "" {
+		loc, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %v", err)
+		}
+		s.Cron, err = scheduler.ParseCron(r.Cron, loc)
+		return s, err
+	}
+	var err error
+	s.Every, err = parseInterval(r.Interval)
+	return s, err
+}
+
+// nextRuns returns up to n runs of s after t.
+func nextRuns(s *RecurringSchedule, t time.Time, n int) []time.Time {
+	r := []time.Time{}
+	for len(r) < n {
+		if t = s.Next(t); t.IsZero() {
+			break
+		}
+		r = append(r, t)
+	}
+	return r
+}
+
+// startRecurring schedules r from now on, with the runs it has left, and
+// marks it finished if there are none. Nothing is saved or scheduled if r is
+// no longer in the status it was read in.
+func (s *Server) startRecurring(r *database.Recurring, now time.Time) error {
+	from := r.Status
+	r.Until = r.End
+	sched, err := recurringSchedule(*r)
+	if err != nil {
+		return err
+	}
+	if r.Max > 0 {
+		left := r.Max - r.Count
+		if runs := nextRuns(sched, now, left); left > 0 && len(runs) == left {
+			r.Until = runs[left-1]
+		} else if left <= 0 {
+			r.Until = now
+		}
+		sched.Until = r.Until
+	}
+	r.Status, r.Entry, r.Updated = database.RecurringActive, "", now
+	if sched.Next(now).IsZero() {
+		r.Status = database.RecurringFinished
+		return s.setRecurringState(*r, from)
+	}
+	entry := s.scheduler.AddJob(&RecurringPushJob{recurring: r.ID, session: r.Session, group: r.Group, srv: s}, sched)
+	r.Entry = entry.(database.Entry).GetID()
+	if err := s.setRecurringState(*r, from); err != nil {
+		s.scheduler.Remove(entry)
+		return err
+	}
+	return nil
+}
+
+// setRecurringState saves the state of r if its status is still from.
+func (s *Server) setRecurringState(r database.Recurring, from string) error {
+	ok, err := s.db.SetRecurringState(r, from)
+	if err == nil && !ok {
+		err = fmt.Errorf("recurring %v is no longer %v", r.ID, from)
+	}
+	return err
+}
+
+// stopRecurring removes the scheduler entry of r.
+func (s *Server) stopRecurring(r *database.Recurring) {
+	if r.Entry != "" {
+		if err := s.removeEntry(r.Entry); err != nil {
+			fmt.Printf("recurring %v: %v\n", r.ID, err)
+		}
+	}
+	r.Entry = ""
+}
+
+// recurringMessage returns the message of a run of r at t.
+func recurringMessage(r database.Recurring, t time.Time) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal([]byte(r.Message), &m); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.tags, err = parseTagExpr(r.Tags); err != nil {
+		return nil, err
+	}
+	if r.TTL != "" {
+		m.ExpiresAt, err = parseExpiry(map[string]string{"ttl": r.TTL}, t)
+	}
+	return &m, err
+}
+
+// RecurringPushJob pushes the message of a recurring push each time its
+// schedule fires.
+type RecurringPushJob struct {
+	recurring string
+	session   string
+	group     string
+	srv       *Server
+}
+
+func (j *RecurringPushJob) bind(s *Server) {
+	j.srv = s
+}
+
+func (j *RecurringPushJob) Run() {
+	if j.srv == nil {
+		return
+	}
+	if err := j.srv.recur(j.recurring); err != nil {
+		fmt.Printf("recurring %v: %v\n", j.recurring, err)
+	}
+}
+
+func (s *Server) recur(id string) error {
+	r, err := s.db.GetRecurringByID(id)
+	if err != nil || r.Status != database.RecurringActive {
+		return err
+	}
+	now := time.Now()
+	m, err := recurringMessage(r, now)
+	if err != nil {
+		return err
+	}
+	if r.Group != "" {
+		g, err := s.db.GetGroupByID(r.Group)
+		if err == nil {
+			_, err = Group{g}.Push(m, s)
+		}
+		if err != nil {
+			fmt.Printf("recurring %v: push to group %v: %v\n", id, r.Group, err)
+		}
+	} else {
+		session, err := s.db.GetSessionByID(r.Session)
+		if err == nil {
+			if res := (Session{session}).Push(m, s); res.Err != nil && !accepted(res.Err) {
+				err = res.Err
+			}
+		}
+		if err != nil {
+			fmt.Printf("recurring %v: push to session %v: %v\n", id, r.Session, err)
+		}
+	}
+	sched, err := recurringSchedule(r)
+	if err != nil {
+		return err
+	}
+	// finish once Max is reached, or after the last run of the schedule,
+	// which comes earlier when runs were missed while the program was down
+	last := sched.Next(now).IsZero()
+	finished := last || (r.Max > 0 && r.Count+1 >= r.Max)
+	active, err := s.db.RecordRecurringRun(id, now, finished)
+	if err == nil && active && finished && !last {
+		s.stopRecurring(&r)
+	}
+	return err
+}
+
+func (j *RecurringPushJob) Save() (bson.M, error) {
+	return bson.M{"recurring": j.recurring, "session": j.session, "group": j.group}, nil
+}
+
+func (j *RecurringPushJob) Load(m bson.M) error {
+	id, ok := m["recurring"].(string)
+	if !ok {
+		return fmt.Errorf("missing recurring")
+	}
+	j.recurring = id
+	j.session, _ = m["session"].(string)
+	j.group, _ = m["group"].(string)
+	return nil
+}
+
+func (j *RecurringPushJob) GetType() string {
+	return "RecurringPushJob"
+}
+
+func (j *RecurringPushJob) IsType(t string) bool {
+	return t == "RecurringPushJob"
+}
+
+// recurringWsgoH describes r with its next n runs if it is active.
+func recurringWsgoH(r database.Recurring, n int) wsgo.H {
+	ret := wsgo.H{"id": r.ID, "start": r.Start, "count": r.Count, "status": r.Status, "created": r.Created,
+		"updated": r.Updated}
+	for k, v := range map[string]string{"session": r.Session, "group": r.Group, "tags": r.Tags, "ttl": r.TTL,
+		"interval": r.Interval, "cron": r.Cron, "timezone": r.Timezone} {
+		if v != "" {
+			ret[k] = v
+		}
+	}
+	if r.Max > 0 {
+		ret["max"] = r.Max
+	}
+	for k, t := range map[string]time.Time{"end": r.End, "last": r.Last} {
+		if !t.IsZero() {
+			ret[k] = t
+		}
+	}
+	var m Message
+	if json.Unmarshal([]byte(r.Message), &m) == nil {
+		ret["message"] = m
+	}
+	if r.Status == database.RecurringActive {
+		if sched, err := recurringSchedule(r); err == nil {
+			ret["next"] = nextRuns(sched, time.Now(), n)
+		}
+	}
+	return ret
+}
+
+// nextParam reads how many upcoming runs to show.
+func nextParam(c *wsgo.Context) (int, error) {
+	n, ok, err := intParam(c, "next")
+	if !ok || n <= 0 {
+		n = DefaultNextRuns
+	}
+	if n > MaxNextRuns {
+		n = MaxNextRuns
+	}
+	return n, err
+}
+
+func (s *Server) handleRecurring(r *wsgo.ServerMux) {
+	// push a message to a session or a group every interval or at the times of a cron spec
+	// session={sessionid}&group={groupid}&author={}&title={}&content={}&priority={}&topic={}&tags={}&ttl={}
+	// &interval={1h}&cron={}&timezone={}&start={}&end={}&max={}&next={}
+	r.Handle(s.prefix+"/recurring/create", func(c *wsgo.Context) {
+		ps := c.StringParams()
+		now := time.Now()
+		rec := database.Recurring{Session: ps["session"], Group: ps["group"], Tags: ps["tags"], TTL: ps["ttl"],
+			Interval: ps["interval"], Cron: ps["cron"], Created: now}
+		m := Message{Author: ps["author"], Title: ps["title"], Content: ps["content"], Topic: ps["topic"]}
+		var err error
+		loc := time.Local
+		switch {
+		case (rec.Session == "") == (rec.Group == ""):
+			err = fmt.Errorf("recurring push needs a session or a group")
+		case (rec.Interval == "") == (rec.Cron == ""):
+			err = fmt.Errorf("recurring push takes either interval or cron")
+		case rec.Session != "":
+			var session database.Session
+			if session, err = s.db.GetSessionByID(rec.Session); err == nil {
+				loc = Session{session}.location()
+			}
+		default:
+			_, err = s.db.GetGroupByID(rec.Group)
+		}
+		if err == nil && ps["timezone"] != "" {
+			loc, err = time.LoadLocation(ps["timezone"])
+		}
+		if err == nil {
+			m.Priority, err = ParsePriority(ps["priority"])
+		}
+		if err == nil {
+			_, err = parseTagExpr(rec.Tags)
+		}
+		if err == nil && rec.TTL != "" {
+			_, err = parseExpiry(map[string]string{"ttl": rec.TTL}, now)
+		}
+		if err == nil {
+			rec.Start, err = timeParam(ps, "start", now, loc)
+		}
+		if err == nil {
+			rec.End, err = timeParam(ps, "end", now, loc)
+		}
+		if err == nil {
+			rec.Max, _, err = intParam(c, "max")
+		}
+		if err == nil && rec.Max < 0 {
+			err = fmt.Errorf("invalid max: %v", rec.Max)
+		}
+		if err == nil && rec.Start.IsZero() {
+			rec.Start = now
+		}
+		if err == nil && !rec.End.IsZero() && !rec.End.After(rec.Start) {
+			err = fmt.Errorf("end must be after start")
+		}
+		n, err2 := nextParam(c)
+		if err == nil {
+			err = err2
+		}
+		if err == nil {
+			rec.Timezone = loc.String()
+			rec.Until = rec.End
+			var sched *RecurringSchedule
+			if sched, err = recurringSchedule(rec); err == nil && sched.Next(now).IsZero() {
+				err = fmt.Errorf("recurring push would never run")
+			}
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		b, err := json.Marshal(m)
+		if err == nil {
+			rec.Message = string(b)
+			rec.Status, rec.Updated = database.RecurringActive, now
+			rec.ID, err = s.db.NewRecurring(rec)
+		}
+		if err == nil {
+			err = s.startRecurring(&rec, now)
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("new recurring: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, recurringWsgoH(rec, n))
+	})
+	// latest recurring pushes, of a session or group and in a status if given
+	// session={sessionid}&group={groupid}&status={active|paused|finished}&limit={}
+	r.Handle(s.prefix+"/recurring/list", func(c *wsgo.Context) {
+		ps := c.StringParams()
+		limit, _, err := intParam(c, "limit")
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if limit <= 0 || limit > database.MaxListLimit {
+			limit = database.DefaultListLimit
+		}
+		rs, err := s.db.GetRecurrings(ps["session"], ps["group"], ps["status"], limit)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("GetRecurrings: %v", err)
+			return
+		}
+		ret := []wsgo.H{}
+		for _, rec := range rs {
+			ret = append(ret, recurringWsgoH(rec, 1))
+		}
+		c.Json(http.StatusOK, ret)
+	})
+	// recurring push with its next runs
+	// recurring={recurringid}&next={}
+	r.Handle(s.prefix+"/recurring/check", requireString("recurring"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("recurring")
+		rec, err := s.db.GetRecurringByID(id)
+		n, err2 := nextParam(c)
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, recurringWsgoH(rec, n))
+	})
+	// recurring={recurringid}
+	r.Handle(s.prefix+"/recurring/pause", requireString("recurring"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("recurring")
+		rec, err := s.db.GetRecurringByID(id)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		entry := rec.Entry
+		rec.Status, rec.Entry, rec.Updated = database.RecurringPaused, "", time.Now()
+		active, err := s.db.SetRecurringState(rec, database.RecurringActive)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("recurring %v pause: %v", id, err)
+			return
+		}
+		if !active {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: recurring %v is not active", id)
+			return
+		}
+		rec.Entry = entry
+		s.stopRecurring(&rec)
+	})
+	// runs missed while paused are skipped
+	// recurring={recurringid}&next={}
+	r.Handle(s.prefix+"/recurring/resume", requireString("recurring"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("recurring")
+		rec, err := s.db.GetRecurringByID(id)
+		if err == nil && rec.Status != database.RecurringPaused {
+			err = fmt.Errorf("recurring %v is %v", id, rec.Status)
+		}
+		n, err2 := nextParam(c)
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := s.startRecurring(&rec, time.Now()); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("recurring %v resume: %v", id, err)
+			return
+		}
+		c.Json(http.StatusOK, recurringWsgoH(rec, n))
+	})
+	// recurring={recurringid}
+	r.Handle(s.prefix+"/recurring/delete", requireString("recurring"), func(c *wsgo.Context) {
+		id, _ := c.StringParam("recurring")
+		rec, err := s.db.GetRecurringByID(id)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		s.stopRecurring(&rec)
+		if err := s.db.DeleteRecurring(id); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("recurring %v delete: %v", id, err)
+			return
+		}
+	})
+}
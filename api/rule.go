@@ -0,0 +1,464 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const (
+	SignatureToken      = "token"
+	SignatureHMACSHA1   = "hmac-sha1"
+	SignatureHMACSHA256 = "hmac-sha256"
+	SignatureHMACSHA512 = "hmac-sha512"
+	SignatureStripe     = "stripe"
+)
+
+// stripeTolerance is how old a Stripe signature timestamp may be.
+const stripeTolerance = 5 * time.Minute
+
+// pathStep is one step of a JSON path: an object key or an array index.
+type pathStep struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parsePath parses the JSON path subset $.a.b, $.a[0], $["a b"] and $.a[-1].
+func parsePath(expr string) ([]pathStep, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("json path %q must start with $", expr)
+	}
+	var steps []pathStep
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			i := strings.IndexAny(rest, ".[")
+			if i < 0 {
+				i = len(rest)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("json path %q: empty key", expr)
+			}
+			steps = append(steps, pathStep{key: rest[:i], isKey: true})
+			rest = rest[i:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: missing ]", expr)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1], isKey: true})
+			} else {
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("json path %q: invalid index %q", expr, inner)
+				}
+				steps = append(steps, pathStep{index: n})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path %q: unexpected %q", expr, rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// lookupPath returns the value at expr in v, or nil if it does not exist.
+func lookupPath(v any, expr string) (any, error) {
+	steps, err := parsePath(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		switch t := v.(type) {
+		case map[string]any:
+			if !s.isKey {
+				return nil, nil
+			}
+			v = t[s.key]
+		case []any:
+			if s.isKey {
+				return nil, nil
+			}
+			i := s.index
+			if i < 0 {
+				i += len(t)
+			}
+			if i < 0 || i >= len(t) {
+				return nil, nil
+			}
+			v = t[i]
+		default:
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+func pathString(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+var pathPlaceholder = regexp.MustCompile(`\{(\$[^{}]*)\}`)
+
+// ruleField evaluates a rule field against the payload. A field starting with
+// $ is a JSON path; other fields are text in which {$.path} is replaced.
+func ruleField(doc any, expr string) (string, error) {
+	if strings.HasPrefix(expr, "$") {
+		v, err := lookupPath(doc, expr)
+		return pathString(v), err
+	}
+	var err error
+	r := pathPlaceholder.ReplaceAllStringFunc(expr, func(m string) string {
+		v, e := lookupPath(doc, m[1:len(m)-1])
+		if e != nil {
+			err = e
+		}
+		return pathString(v)
+	})
+	return r, err
+}
+
+func checkRuleField(expr string) error {
+	if strings.HasPrefix(expr, "$") {
+		_, err := parsePath(expr)
+		return err
+	}
+	for _, m := range pathPlaceholder.FindAllStringSubmatch(expr, -1) {
+		if _, err := parsePath(m[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRule(r database.Rule) error {
+	for _, f := range []string{r.Author, r.Title, r.Content, r.Priority} {
+		if err := checkRuleField(f); err != nil {
+			return err
+		}
+	}
+	if r.Title == "" && r.Content == "" {
+		return fmt.Errorf("rule needs a title or a content")
+	}
+	if !strings.Contains(r.Priority, "$") {
+		if _, err := ParsePriority(r.Priority); err != nil {
+			return err
+		}
+	}
+	sig := r.Signature
+	switch sig.Type {
+	case "":
+		return nil
+	case SignatureToken, SignatureHMACSHA1, SignatureHMACSHA256, SignatureHMACSHA512, SignatureStripe:
+	default:
+		return fmt.Errorf("unknown signature type: %s", sig.Type)
+	}
+	switch sig.Encoding {
+	case "", "hex", "base64":
+	default:
+		return fmt.Errorf("unknown signature encoding: %s", sig.Encoding)
+	}
+	if sig.Secret == "" {
+		return fmt.Errorf("signature %s needs a secret", sig.Type)
+	}
+	return nil
+}
+
+// ruleWsgoH describes a rule without its signature secret.
+func ruleWsgoH(r database.Rule) wsgo.H {
+	sig := r.Signature
+	sig.Secret = ""
+	return wsgo.H{"id": r.ID, "name": r.Name, "group": r.Group, "author": r.Author, "title": r.Title,
+		"content": r.Content, "priority": r.Priority, "signature": sig}
+}
+
+func signatureHash(t string) func() hash.Hash {
+	switch t {
+	case SignatureHMACSHA1:
+		return sha1.New
+	case SignatureHMACSHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+func decodeSignature(enc string, s string) ([]byte, error) {
+	if enc == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+// verifySignature checks the request against the rule signature. Token
+// signatures compare a header with the secret; HMAC signatures sign the raw
+// body, Stripe signatures the timestamp and the body.
+func verifySignature(sig database.RuleSignature, r *http.Request, body []byte) error {
+	if sig.Type == "" {
+		return nil
+	}
+	header := sig.Header
+	if header == "" {
+		switch sig.Type {
+		case SignatureToken:
+			header = "X-Token"
+		case SignatureStripe:
+			header = "Stripe-Signature"
+		default:
+			header = "X-Signature"
+		}
+	}
+	v := r.Header.Get(header)
+	if v == "" {
+		return fmt.Errorf("missing signature header %s", header)
+	}
+	switch sig.Type {
+	case SignatureToken:
+		if !hmac.Equal([]byte(v), []byte(sig.Prefix+sig.Secret)) {
+			return fmt.Errorf("token mismatch")
+		}
+		return nil
+	case SignatureStripe:
+		var ts string
+		var sigs []string
+		for _, part := range strings.Split(v, ",") {
+			k, val, _ := strings.Cut(part, "=")
+			switch k {
+			case "t":
+				ts = val
+			case "v1":
+				sigs = append(sigs, val)
+			}
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid stripe timestamp: %v", err)
+		}
+		if d := time.Since(time.Unix(sec, 0)); d > stripeTolerance || d < -stripeTolerance {
+			return fmt.Errorf("stripe timestamp out of tolerance")
+		}
+		mac := hmac.New(sha256.New, []byte(sig.Secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		want := mac.Sum(nil)
+		for _, s := range sigs {
+			if got, err := hex.DecodeString(s); err == nil && hmac.Equal(got, want) {
+				return nil
+			}
+		}
+		return fmt.Errorf("signature mismatch")
+	}
+	got, err := decodeSignature(sig.Encoding, strings.TrimPrefix(v, sig.Prefix))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	mac := hmac.New(signatureHash(sig.Type), []byte(sig.Secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// ruleMessage builds the message for a payload.
+func ruleMessage(r database.Rule, doc any) (Message, error) {
+	var m Message
+	var err error
+	fields := []struct {
+		expr string
+		dst  *string
+	}{{r.Author, &m.Author}, {r.Title, &m.Title}, {r.Content, &m.Content}}
+	for _, f := range fields {
+		if *f.dst, err = ruleField(doc, f.expr); err != nil {
+			return m, err
+		}
+	}
+	p, err := ruleField(doc, r.Priority)
+	if err != nil {
+		return m, err
+	}
+	if m.Priority, err = ParsePriority(strings.ToLower(p)); err != nil {
+		m.Priority = PriorityNormal
+	}
+	return m, nil
+}
+
+// ruleParams reads the rule fields given in the request into r.
+func ruleParams(c *wsgo.Context, r *database.Rule) error {
+	ps := c.StringParams()
+	fields := map[string]*string{"name": &r.Name, "group": &r.Group, "author": &r.Author, "title": &r.Title,
+		"content": &r.Content, "priority": &r.Priority}
+	for k, dst := range fields {
+		if v, ok := ps[k]; ok {
+			*dst = v
+		}
+	}
+	return bindParam(c, "signature", &r.Signature)
+}
+
+func (s *Server) handleRules(r *wsgo.ServerMux) {
+	// create an inbound rule; author, title, content and priority are JSON paths ($.a.b) or text with {$.a.b}
+	// name={}&group={groupid}&author={}&title={}&content={}&priority={}&signature={type,header,prefix,encoding,secret}
+	r.Handle(s.prefix+"/rule/create", requireString("group"), func(c *wsgo.Context) {
+		var rule database.Rule
+		err := ruleParams(c, &rule)
+		if err == nil {
+			err = checkRule(rule)
+		}
+		if err == nil {
+			_, err = s.db.GetGroupByID(rule.Group)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		id, err := s.db.NewRule(rule)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("NewRule: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, wsgo.H{"id": id})
+	})
+	// update the given fields of a rule
+	// rule={ruleid}&name={}&group={groupid}&author={}&title={}&content={}&priority={}&signature={}
+	r.Handle(s.prefix+"/rule/update", requireString("rule"), func(c *wsgo.Context) {
+		rid, _ := c.StringParam("rule")
+		rule, err := s.db.GetRuleByID(rid)
+		if err == nil {
+			err = ruleParams(c, &rule)
+		}
+		if err == nil {
+			err = checkRule(rule)
+		}
+		if err == nil {
+			_, err = s.db.GetGroupByID(rule.Group)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := s.db.UpdateRule(rule); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("rule %v update: %v", rid, err)
+			return
+		}
+		c.Json(http.StatusOK, ruleWsgoH(rule))
+	})
+	// rule={ruleid}
+	r.Handle(s.prefix+"/rule/delete", requireString("rule"), func(c *wsgo.Context) {
+		rid, _ := c.StringParam("rule")
+		if err := s.db.DeleteRule(rid); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.String(http.StatusOK, "")
+	})
+	// rule={ruleid}
+	r.Handle(s.prefix+"/rule/check", requireString("rule"), func(c *wsgo.Context) {
+		rid, _ := c.StringParam("rule")
+		rule, err := s.db.GetRuleByID(rid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, ruleWsgoH(rule))
+	})
+	r.Handle(s.prefix+"/rule/list", func(c *wsgo.Context) {
+		rules, err := s.db.GetAllRules()
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("GetAllRules: %v", err)
+			return
+		}
+		ret := []wsgo.H{}
+		for _, rule := range rules {
+			ret = append(ret, ruleWsgoH(rule))
+		}
+		c.Json(http.StatusOK, ret)
+	})
+	// POST /hook/{ruleid} with any JSON body
+	r.POST(s.prefix+"/hook/*", func(c *wsgo.Context) {
+		req := c.GetRequest()
+		rid := strings.TrimPrefix(req.URL.Path, s.prefix+"/hook/")
+		rule, err := s.db.GetRuleByID(rid)
+		if err != nil {
+			c.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			c.Log("hook %q: %v", rid, err)
+			return
+		}
+		body, err := c.ReadAllBody()
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := verifySignature(rule.Signature, req, body); err != nil {
+			c.String(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			c.Log("Unauthorized: hook %v: %v", rid, err)
+			return
+		}
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		m, err := ruleMessage(rule, doc)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		g, err := s.db.GetGroupByID(rule.Group)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("hook %v group %v: %v", rid, rule.Group, err)
+			return
+		}
+		resps, err := Group{g}.Push(&m, s)
+		if err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("push to group %v: %v", rule.Group, err)
+			return
+		}
+		succ := []string{}
+		for _, resp := range resps {
+			if resp.Err == nil || accepted(resp.Err) {
+				succ = append(succ, resp.Session.GetID())
+			} else {
+				c.Log("push to group session %v: %v", resp.Session.GetID(), resp.Err)
+			}
+		}
+		c.Json(http.StatusOK, succ)
+	})
+}
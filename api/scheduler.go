@@ -1,7 +1,7 @@
 package api
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -18,6 +18,18 @@ func ScheduleGetter(t string, m bson.M) (database.Schedule, error) {
 		s := OneTimeSchedule{}
 		err := s.Load(m)
 		return &s, err
+	case "IntervalSchedule":
+		s := IntervalSchedule{}
+		err := s.Load(m)
+		return &s, err
+	case "CronSchedule":
+		s := CronSchedule{}
+		err := s.Load(m)
+		return &s, err
+	case "RecurringSchedule":
+		s := RecurringSchedule{}
+		err := s.Load(m)
+		return &s, err
 	}
 	return nil, fmt.Errorf("unknown schedule type: %s", t)
 }
@@ -28,6 +40,22 @@ func JobGetter(t string, m bson.M) (database.Job, error) {
 		j := PushToSessionJob{}
 		err := j.Load(m)
 		return &j, err
+	case "DigestFlushJob":
+		j := DigestFlushJob{}
+		err := j.Load(m)
+		return &j, err
+	case "AckTimeoutJob":
+		j := AckTimeoutJob{}
+		err := j.Load(m)
+		return &j, err
+	case "EscalationStepJob":
+		j := EscalationStepJob{}
+		err := j.Load(m)
+		return &j, err
+	case "RecurringPushJob":
+		j := RecurringPushJob{}
+		err := j.Load(m)
+		return &j, err
 	}
 	return nil, fmt.Errorf("unknown job type: %s", t)
 }
@@ -78,21 +106,359 @@ func (s *OneTimeSchedule) IsType(t string) bool {
 	return t == "OneTimeSchedule"
 }
 
+type IntervalSchedule struct {
+	scheduler.IntervalSchedule
+}
+
+func NewIntervalSchedule(every time.Duration) *IntervalSchedule {
+	return &IntervalSchedule{scheduler.IntervalSchedule{Every: every}}
+}
+
+func (s *IntervalSchedule) Save() (bson.M, error) {
+	return bson.M{"every": s.Every.String()}, nil
+}
+
+func (s *IntervalSchedule) Load(m bson.M) error {
+	e, ok := m["every"].(string)
+	if !ok {
+		return fmt.Errorf("missing every")
+	}
+	d, err := time.ParseDuration(e)
+	if err != nil {
+		return fmt.Errorf("invalid 'every': %v", err)
+	}
+	s.Every = d
+	return nil
+}
+
+func (s *IntervalSchedule) GetType() string {
+	return "IntervalSchedule"
+}
+
+func (s *IntervalSchedule) IsType(t string) bool {
+	return t == "IntervalSchedule"
+}
+
+type CronSchedule struct {
+	*scheduler.CronSchedule
+}
+
+func NewCronSchedule(spec string, loc *time.Location) (*CronSchedule, error) {
+	c, err := scheduler.ParseCron(spec, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &CronSchedule{c}, nil
+}
+
+func (s *CronSchedule) Save() (bson.M, error) {
+	return bson.M{"spec": s.Spec, "timezone": s.Location.String()}, nil
+}
+
+func (s *CronSchedule) Load(m bson.M) error {
+	spec, ok := m["spec"].(string)
+	if !ok {
+		return fmt.Errorf("missing spec")
+	}
+	tz, _ := m["timezone"].(string)
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("invalid 'timezone': %v", err)
+	}
+	c, err := scheduler.ParseCron(spec, loc)
+	if err != nil {
+		return err
+	}
+	s.CronSchedule = c
+	return nil
+}
+
+func (s *CronSchedule) GetType() string {
+	return "CronSchedule"
+}
+
+func (s *CronSchedule) IsType(t string) bool {
+	return t == "CronSchedule"
+}
+
+// RecurringSchedule fires every Every from Start, or at the times of Cron
+// from Start on, and stops after Until unless it is zero.
+type RecurringSchedule struct {
+	Every time.Duration
+	Cron  *scheduler.CronSchedule
+	Start time.Time
+	Until time.Time
+}
+
+func (s *RecurringSchedule) Next(t time.Time) time.Time {
+	var r time.Time
+	switch {
+	case s.Cron != nil:
+		if t.Before(s.Start) {
+			t = s.Start.Add(-time.Nanosecond)
+		}
+		r = s.Cron.Next(t)
+	case s.Every <= 0:
+		return time.Time{}
+	case t.Before(s.Start):
+		r = s.Start
+	default:
+		r = s.Start.Add((t.Sub(s.Start)/s.Every + 1) * s.Every)
+	}
+	if !s.Until.IsZero() && r.After(s.Until) {
+		return time.Time{}
+	}
+	return r
+}
+
+func (s *RecurringSchedule) Save() (bson.M, error) {
+	m := bson.M{"start": s.Start.Format(time.RFC3339Nano)}
+	if s.Cron != nil {
+		m["spec"], m["timezone"] = s.Cron.Spec, s.Cron.Location.String()
+	} else {
+		m["every"] = s.Every.String()
+	}
+	if !s.Until.IsZero() {
+		m["until"] = s.Until.Format(time.RFC3339Nano)
+	}
+	return m, nil
+}
+
+func (s *RecurringSchedule) Load(m bson.M) error {
+	start, ok := m["start"].(string)
+	if !ok {
+		return fmt.Errorf("missing start")
+	}
+	var err error
+	if s.Start, err = time.Parse(time.RFC3339Nano, start); err != nil {
+		return fmt.Errorf("invalid 'start': %v", err)
+	}
+	if until, ok := m["until"].(string); ok {
+		if s.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return fmt.Errorf("invalid 'until': %v", err)
+		}
+	}
+	if _, ok := m["spec"]; ok {
+		c := CronSchedule{}
+		if err := c.Load(m); err != nil {
+			return err
+		}
+		s.Cron = c.CronSchedule
+		return nil
+	}
+	e, ok := m["every"].(string)
+	if !ok {
+		return fmt.Errorf("missing every")
+	}
+	if s.Every, err = time.ParseDuration(e); err != nil {
+		return fmt.Errorf("invalid 'every': %v", err)
+	}
+	return nil
+}
+
+func (s *RecurringSchedule) GetType() string {
+	return "RecurringSchedule"
+}
+
+func (s *RecurringSchedule) IsType(t string) bool {
+	return t == "RecurringSchedule"
+}
+
+// removeEntry removes a scheduler entry by id.
+func (s *Server) removeEntry(id string) error {
+	e, err := s.db.GetEntryByID(id, ScheduleGetter, s.jobGetter)
+	if err != nil {
+		return fmt.Errorf("remove entry %v: %v", id, err)
+	}
+	s.scheduler.Remove(e)
+	return nil
+}
+
+// serverJob is implemented by jobs that need the server when they run.
+type serverJob interface {
+	bind(s *Server)
+}
+
+// jobGetter loads a job with JobGetter and binds it to the server.
+func (s *Server) jobGetter(t string, m bson.M) (database.Job, error) {
+	j, err := JobGetter(t, m)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := j.(serverJob); ok {
+		b.bind(s)
+	}
+	return j, nil
+}
+
 type PushToSessionJob struct {
-	url  string
-	data []byte
+	req        request
+	priority   Priority
+	expiresAt  int64
+	deliveries []string
+	attempt    int
+	limited    int
+	srv        *Server
 }
 
-func NewPushToSessionJob(url string, data []byte) *PushToSessionJob {
-	return &PushToSessionJob{url: url, data: data}
+// maxRateLimited bounds how often a job waits out rate limits, on top of the
+// retries allowed by its priority.
+const maxRateLimited = 5
+
+// NewPushToSessionJob creates a job sending req. Priority and expiry are taken
+// from m, and the outcome is recorded in the given deliveries.
+func NewPushToSessionJob(req request, m *Message, deliveries ...string) *PushToSessionJob {
+	return &PushToSessionJob{req: req, priority: m.Priority, expiresAt: m.ExpiresAt, deliveries: deliveries}
+}
+
+func (j *PushToSessionJob) bind(s *Server) {
+	j.srv = s
+}
+
+func (j *PushToSessionJob) Priority() int {
+	return j.priority.Level()
 }
 
 func (j *PushToSessionJob) Run() {
-	http.Post(j.url, "application/json", bytes.NewBuffer(j.data))
+	j.send()
+}
+
+func (j *PushToSessionJob) setStatus(status string, detail string) {
+	if j.srv == nil {
+		return
+	}
+	for _, d := range j.deliveries {
+		j.srv.setDeliveryStatus(d, status, detail)
+	}
+}
+
+// send delivers the request and records the outcome, scheduling a retry on failure.
+func (j *PushToSessionJob) send() (*http.Response, error) {
+	if (&Message{ExpiresAt: j.expiresAt}).expired(time.Now()) {
+		j.setStatus(DeliveryExpired, "")
+		return nil, ErrExpired
+	}
+	var ch Channel = genericChannel{}
+	var session database.Session
+	client := defaultClient
+	if j.srv != nil {
+		client = j.srv.client
+		if j.req.Session != "" {
+			var err error
+			if session, err = j.srv.db.GetSessionByID(j.req.Session); err != nil {
+				err = fmt.Errorf("session %v is gone: %v", j.req.Session, err)
+				j.setStatus(DeliveryDropped, err.Error())
+				return nil, err
+			}
+			if at, open := j.srv.circuitOpen(session); open {
+				j.holdBack(at)
+				return nil, ErrCircuitOpen
+			}
+			if client, err = j.srv.sessionClient(session); err != nil {
+				j.setStatus(DeliveryFailed, err.Error())
+				return nil, err
+			}
+		}
+		ch = j.srv.channel(j.req.Channel)
+	}
+	var resp *http.Response
+	var err error
+	if snd, ok := ch.(sender); ok {
+		err = snd.Send(j.req)
+	} else {
+		var body []byte
+		resp, body, err = j.req.do(client)
+		if err == nil {
+			if wait, ok := ch.RateLimited(resp, body); ok {
+				err = fmt.Errorf("rate limited: %v", resp.Status)
+				j.waitRateLimit(wait, err.Error())
+				return resp, err
+			}
+			if !delivered(resp) {
+				err = fmt.Errorf("hook responded %v", resp.Status)
+			}
+		}
+	}
+	if err == nil {
+		j.setStatus(DeliveryDelivered, "")
+		if session != nil {
+			j.srv.recordSuccess(session)
+		}
+		return resp, nil
+	}
+	if session != nil {
+		j.srv.recordFailure(session, err.Error())
+	}
+	if errors.Is(err, ErrBlocked) {
+		j.setStatus(DeliveryFailed, err.Error())
+		return resp, err
+	}
+	j.retry(err.Error())
+	return resp, err
+}
+
+// retry schedules the next attempt if the priority allows one and the message
+// will not have expired by then.
+func (j *PushToSessionJob) retry(detail string) {
+	d, ok := j.priority.retryDelay(j.attempt + 1)
+	at := time.Now().Add(d)
+	switch {
+	case !ok || j.srv == nil:
+		j.setStatus(DeliveryFailed, detail)
+	case (&Message{ExpiresAt: j.expiresAt}).expired(at):
+		j.setStatus(DeliveryExpired, detail)
+	default:
+		next := *j
+		next.attempt++
+		j.srv.scheduler.AddJob(&next, NewOneTimeSchedule(at))
+		j.setStatus(DeliveryRetrying, fmt.Sprintf("attempt %d at %v: %v", next.attempt, at.Format(time.RFC3339), detail))
+	}
+}
+
+// waitRateLimit schedules the next attempt once the receiver's rate limit is
+// over. Jobs limited too often fall back to their normal retries.
+func (j *PushToSessionJob) waitRateLimit(wait time.Duration, detail string) {
+	if j.limited >= maxRateLimited || j.srv == nil {
+		j.retry(detail)
+		return
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	at := time.Now().Add(wait)
+	if (&Message{ExpiresAt: j.expiresAt}).expired(at) {
+		j.setStatus(DeliveryExpired, detail)
+		return
+	}
+	next := *j
+	next.limited++
+	j.srv.scheduler.AddJob(&next, NewOneTimeSchedule(at))
+	j.setStatus(DeliveryRetrying, fmt.Sprintf("rate limited, retry at %v", at.Format(time.RFC3339)))
+}
+
+// holdBack queues the job until at while the session circuit is open, or
+// drops it if the breaker is set to.
+func (j *PushToSessionJob) holdBack(at time.Time) {
+	switch {
+	case j.srv.breaker.Mode == BreakerDrop:
+		j.setStatus(DeliveryDropped, ErrCircuitOpen.Error())
+	case (&Message{ExpiresAt: j.expiresAt}).expired(at):
+		j.setStatus(DeliveryExpired, ErrCircuitOpen.Error())
+	default:
+		next := *j
+		j.srv.scheduler.AddJob(&next, NewOneTimeSchedule(at))
+		j.setStatus(DeliveryDeferred, fmt.Sprintf("circuit open, retry at %v", at.Format(time.RFC3339)))
+	}
 }
 
 func (j *PushToSessionJob) Save() (bson.M, error) {
-	return bson.M{"url": j.url, "data": string(j.data)}, nil
+	header := bson.M{}
+	for k, v := range j.req.Header {
+		header[k] = v
+	}
+	return bson.M{"session": j.req.Session, "url": j.req.URL, "data": string(j.req.Body), "method": j.req.Method,
+		"header": header, "channel": j.req.Channel, "priority": string(j.priority), "attempt": j.attempt, "limited": j.limited,
+		"expiresAt": j.expiresAt, "deliveries": j.deliveries}, nil
 }
 
 func (j *PushToSessionJob) Load(m bson.M) error {
@@ -100,7 +466,7 @@ func (j *PushToSessionJob) Load(m bson.M) error {
 	if !ok {
 		return fmt.Errorf("missing url")
 	}
-	j.url, ok = url.(string)
+	j.req.URL, ok = url.(string)
 	if !ok {
 		return fmt.Errorf("url is not a string")
 	}
@@ -112,7 +478,44 @@ func (j *PushToSessionJob) Load(m bson.M) error {
 	if !ok {
 		return fmt.Errorf("data is not a string")
 	}
-	j.data = []byte(s)
+	j.req.Body = []byte(s)
+	j.req.Session, _ = m["session"].(string)
+	j.req.Channel, _ = m["channel"].(string)
+	j.req.Method, _ = m["method"].(string)
+	if j.req.Method == "" {
+		j.req.Method = http.MethodPost
+	}
+	j.req.Header = map[string]string{}
+	if h, ok := m["header"].(bson.M); ok {
+		for k, v := range h {
+			if v, ok := v.(string); ok {
+				j.req.Header[k] = v
+			}
+		}
+	} else {
+		j.req.Header["Content-Type"] = "application/json"
+	}
+	p, _ := m["priority"].(string)
+	priority, err := ParsePriority(p)
+	if err != nil {
+		return err
+	}
+	j.priority = priority
+	j.attempt, _ = intValue(m["attempt"])
+	j.limited, _ = intValue(m["limited"])
+	if e, ok := m["expiresAt"].(int64); ok {
+		j.expiresAt = e
+	}
+	if d, ok := m["delivery"].(string); ok && d != "" {
+		j.deliveries = append(j.deliveries, d)
+	}
+	if ds, ok := m["deliveries"].(bson.A); ok {
+		for _, d := range ds {
+			if id, ok := d.(string); ok {
+				j.deliveries = append(j.deliveries, id)
+			}
+		}
+	}
 	return nil
 }
 
@@ -123,3 +526,51 @@ func (j *PushToSessionJob) GetType() string {
 func (j *PushToSessionJob) IsType(t string) bool {
 	return t == "PushToSessionJob"
 }
+
+type DigestFlushJob struct {
+	session string
+	srv     *Server
+}
+
+func NewDigestFlushJob(session string) *DigestFlushJob {
+	return &DigestFlushJob{session: session}
+}
+
+func (j *DigestFlushJob) bind(s *Server) {
+	j.srv = s
+}
+
+func (j *DigestFlushJob) Run() {
+	if j.srv == nil {
+		return
+	}
+	session, err := j.srv.db.GetSessionByID(j.session)
+	if err != nil {
+		fmt.Printf("digest flush: %v\n", err)
+		return
+	}
+	if err := (Session{session}).FlushDigest(j.srv); err != nil {
+		fmt.Printf("digest flush %v: %v\n", j.session, err)
+	}
+}
+
+func (j *DigestFlushJob) Save() (bson.M, error) {
+	return bson.M{"session": j.session}, nil
+}
+
+func (j *DigestFlushJob) Load(m bson.M) error {
+	session, ok := m["session"].(string)
+	if !ok {
+		return fmt.Errorf("missing session")
+	}
+	j.session = session
+	return nil
+}
+
+func (j *DigestFlushJob) GetType() string {
+	return "DigestFlushJob"
+}
+
+func (j *DigestFlushJob) IsType(t string) bool {
+	return t == "DigestFlushJob"
+}
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/turbitcat/tbcpusher/v2/database"
@@ -16,15 +19,31 @@ type Server struct {
 	prefix    string
 	router    *wsgo.ServerMux
 	scheduler *scheduler.Scheduler
+	channels  map[string]Channel
+
+	restoreWindow time.Duration
+	verifyHooks   bool
+	publicURL     string
+	breaker       Breaker
+	ackSecret     []byte
+	outbound      *outbound
+	clientCfg     ClientConfig
+	client        *http.Client
+	clients       map[database.ClientOptions]*http.Client
+	clientsMu     sync.Mutex
 }
 
-func NewServer(db database.Database) Server {
+func NewServer(db database.Database) *Server {
 	s := wsgo.Default()
 	s.Use(wsgo.ParseParamsJSON)
 	sc := scheduler.NewDefult()
-	list := database.NewEntryList(db, ScheduleGetter, JobGetter)
+	srv := &Server{db: db, addr: ":8000", router: s, scheduler: sc, channels: defaultChannels(),
+		restoreWindow: DefaultRestoreWindow, clientCfg: DefaultClientConfig(), breaker: DefaultBreaker()}
+	srv.SetOutboundPolicy(DefaultOutboundPolicy())
+	srv.SetAckSecret("")
+	list := database.NewEntryList(db, ScheduleGetter, srv.jobGetter)
 	sc.SetEntries(list)
-	return Server{db: db, addr: ":8000", router: s, scheduler: sc}
+	return srv
 }
 
 func (s *Server) SetAddr(addr string) {
@@ -38,6 +57,27 @@ func (s *Server) SetPrefix(p string) {
 	s.prefix = p
 }
 
+// SetTelegramAPI sets the Bot API base URL used by telegram sessions.
+func (s *Server) SetTelegramAPI(base string) {
+	if base != "" {
+		s.channels[ChannelTelegram] = telegramChannel{apiBase: strings.TrimRight(base, "/")}
+	}
+}
+
+// SetWorkers sets how many scheduled deliveries and jobs run at the same time.
+// Each holds a worker for up to the client timeout when a hook hangs, so keep
+// it above the number of hooks that may hang at once.
+func (s *Server) SetWorkers(n int) {
+	if n > 0 {
+		s.scheduler.SetWorkers(n)
+	}
+}
+
+// SetSMTP sets the mail server used by email sessions.
+func (s *Server) SetSMTP(cfg SMTPConfig) {
+	s.channels[ChannelEmail] = emailChannel{cfg: cfg}
+}
+
 func (s *Server) Serve() error {
 	r := s.router
 	// get all groups
@@ -70,12 +110,22 @@ func (s *Server) Serve() error {
 		}
 		c.Json(http.StatusOK, wsgo.H{"id": id})
 	})
-	// create a session
-	// group={groupid}&hook={callbackurl}&data={}
+	// create a session; with verify, or when hooks must be verified, it gets no pushes until the hook
+	// confirms the challenge
+	// group={groupid}&hook={callbackurl}&data={}&channel={}&verify={bool}
 	r.Handle(s.prefix+"/session/create", requireString("hook"), func(c *wsgo.Context) {
 		ps := c.StringParams()
-		gid, hook := ps["group"], ps["hook"]
+		gid, hook, channel := ps["group"], ps["hook"], ps["channel"]
 		data, _ := c.Param("data")
+		err := s.checkChannel(channel)
+		if err == nil {
+			err = s.checkHook(channel, hook)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
 		var sid string
 		if gid != "" {
 			g, err := s.db.GetGroupByID(gid)
@@ -91,7 +141,6 @@ func (s *Server) Serve() error {
 				return
 			}
 		} else {
-			var err error
 			sid, err = s.db.NewSession(hook, data)
 			if err != nil {
 				c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
@@ -99,10 +148,34 @@ func (s *Server) Serve() error {
 				return
 			}
 		}
-		c.Json(http.StatusOK, wsgo.H{"id": sid})
+		if channel != "" {
+			session, err := s.db.GetSessionByID(sid)
+			if err == nil {
+				err = session.SetChannel(channel)
+			}
+			if err != nil {
+				c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				c.Log("session %v set channel %v: %v", sid, channel, err)
+				return
+			}
+		}
+		if !s.verifyHooks && !boolParam(c, "verify") {
+			c.Json(http.StatusOK, wsgo.H{"id": sid})
+			return
+		}
+		state := database.VerificationPending
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			state, err = s.challenge(c, session, hook, true)
+		}
+		if err != nil {
+			c.Log("session %v verify hook: %v", sid, err)
+		}
+		c.Json(http.StatusOK, wsgo.H{"id": sid, "verification": state})
 	})
-	// push to group
-	// group={groupid}&author={}&title={}&content={}
+	// push to group, only to sessions subscribed to topic and matching the tag expression if given;
+	// scheduled pushes return the resolved time
+	// group={groupid}&author={}&title={}&content={}&topic={}&tags={env=prod AND team=db}&when={tomorrow 09:00 Europe/Berlin}
 	r.Handle(s.prefix+"/group/push", requireString("group"), func(c *wsgo.Context) {
 		gid, _ := c.StringParam("group")
 		g, err := s.db.GetGroupByID(gid)
@@ -111,20 +184,22 @@ func (s *Server) Serve() error {
 			c.Log("Bad Request: %v", err)
 			return
 		}
-		ps := c.StringParams()
-		author, title, content := ps["author"], ps["title"], ps["content"]
-		m := Message{author, title, content}
-		if when, ok := c.StringParam("when"); ok {
-			when_int, err := strconv.ParseInt(when, 10, 64)
-			if err != nil {
-				c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
-				c.Log("Bad Request: %v", err)
-				return
-			}
-			ti := time.Unix(0, when_int*1000000)
-			Group{g}.PushWhen(&m, ti, s.scheduler)
+		m, ti, scheduled, err := parsePush(c.StringParams(), time.Local)
+		if err != nil {
+			c.Json(http.StatusBadRequest, wsgo.H{"error": err.Error()})
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := pushTemplate(c, &m, g); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if scheduled {
+			Group{g}.PushWhen(&m, ti, s)
+			c.Json(http.StatusOK, wsgo.H{"when": ti})
 		} else {
-			resps, err := Group{g}.Push(&m)
+			resps, err := Group{g}.Push(&m, s)
 			if err != nil {
 				c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 				c.Log("push to group %v: %v", gid, err)
@@ -141,8 +216,9 @@ func (s *Server) Serve() error {
 			c.Json(http.StatusOK, succ)
 		}
 	})
-	// push to session
-	// session={sessionid}&author={}&title={}&content={}
+	// push to session; with ack_timeout the message is escalated if not acknowledged in time. when is
+	// Unix milliseconds, RFC 3339, +15m, in 2h or a day-time in the session timezone unless it names one
+	// session={sessionid}&author={}&title={}&content={}&when={}&ack_timeout={15m}&escalate_session={}&escalate_group={}
 	r.Handle(s.prefix+"/session/push", requireString("session"), func(c *wsgo.Context) {
 		sid, _ := c.StringParam("session")
 		session, err := s.db.GetSessionByID(sid)
@@ -151,25 +227,48 @@ func (s *Server) Serve() error {
 			c.Log("Bad Request: %v", err)
 			return
 		}
-		ps := c.StringParams()
-		author, title, content := ps["author"], ps["title"], ps["content"]
-		m := Message{author, title, content}
-		if when, ok := c.StringParam("when"); ok {
-			when_int, err := strconv.ParseInt(when, 10, 64)
-			if err != nil {
-				c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
-				c.Log("Bad Request: %v", err)
-				return
-			}
-			ti := time.Unix(0, when_int*1000000)
-			Session{session}.PushWhen(&m, ti, s.scheduler)
+		m, ti, scheduled, err := parsePush(c.StringParams(), Session{session}.location())
+		var esc ackEscalation
+		if err == nil {
+			esc, err = s.parseAckEscalation(c.StringParams())
+		}
+		if err != nil {
+			c.Json(http.StatusBadRequest, wsgo.H{"error": err.Error()})
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		group, _ := session.GetGroup()
+		if err := pushTemplate(c, &m, group); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		var delivery string
+		if scheduled {
+			delivery, err = Session{session}.PushWhen(&m, ti, s)
 		} else {
-			_, err = Session{session}.Push(&m)
-			if err != nil {
-				c.String(http.StatusNotAcceptable, http.StatusText(http.StatusNotAcceptable))
-				return
-			}
+			r := Session{session}.Push(&m, s)
+			delivery, err = r.Delivery, r.Err
 		}
+		if esc.timeout > 0 && delivery != "" && (err == nil || accepted(err) && !errors.Is(err, ErrDropped) &&
+			!errors.Is(err, ErrExpired)) {
+			s.watchAck(delivery, &m, ti, esc.timeout, esc.session, esc.group)
+		}
+		ret := wsgo.H{"delivery": delivery}
+		if scheduled {
+			ret["when"] = ti
+		}
+		if accepted(err) {
+			ret["status"] = err.Error()
+			c.Json(http.StatusAccepted, ret)
+			return
+		}
+		if err != nil {
+			c.String(http.StatusNotAcceptable, http.StatusText(http.StatusNotAcceptable))
+			c.Log("push to session %v: %v", sid, err)
+			return
+		}
+		c.Json(http.StatusOK, ret)
 	})
 	// get session
 	// session={sessionid}
@@ -182,6 +281,8 @@ func (s *Server) Serve() error {
 			return
 		}
 		ret := Session{session}.WsgoHWithGroup()
+		ret["client"] = session.GetClientOptions()
+		ret["health"] = healthWsgoH(session.GetHealth())
 		c.Json(http.StatusOK, ret)
 	})
 	// set session data
@@ -234,6 +335,328 @@ func (s *Server) Serve() error {
 			return
 		}
 	})
+	// set session time zone
+	// session={sessionid}&timezone={IANA name}
+	r.Handle(s.prefix+"/session/settimezone", requireString("session", "timezone"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, tz := ps["session"], ps["timezone"]
+		if _, err := time.LoadLocation(tz); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetTimezone(tz); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set timezone %v: %v", sid, tz, err)
+			return
+		}
+	})
+	// set session quiet hours
+	// session={sessionid}&windows=[{"start":"22:00","end":"07:00"}]&action={defer|drop}
+	r.Handle(s.prefix+"/session/setquiet", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		q := database.QuietHours{Action: c.DefaultStringParam("action", QuietDefer)}
+		if err := bindParam(c, "windows", &q.Windows); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := checkQuietHours(q); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetQuietHours(q); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set quiet hours: %v", sid, err)
+			return
+		}
+	})
+	// set session digest
+	// session={sessionid}&interval={duration}|cron={spec}&max={n}
+	r.Handle(s.prefix+"/session/setdigest", requireString("session"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid := ps["session"]
+		d := database.Digest{Interval: ps["interval"], Cron: ps["cron"]}
+		max, _, err := intParam(c, "max")
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		d.MaxBatch = max
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := (Session{session}).SetDigest(d, s); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("session %v set digest: %v", sid, err)
+			return
+		}
+	})
+	// deliver a session digest now
+	// session={sessionid}
+	r.Handle(s.prefix+"/session/flushdigest", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := (Session{session}).FlushDigest(s); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v flush digest: %v", sid, err)
+			return
+		}
+	})
+	// set a group message template
+	// group={groupid}&name={}&author={}&title={}&content={}
+	r.Handle(s.prefix+"/group/settemplate", requireString("group", "name"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		gid, name := ps["group"], ps["name"]
+		t := database.Template{Author: ps["author"], Title: ps["title"], Content: ps["content"]}
+		if err := checkTemplateName(name); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if _, err := parseMessageTemplate(t); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		group, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := group.SetTemplate(name, t); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v set template %v: %v", gid, name, err)
+			return
+		}
+	})
+	// delete a group message template
+	// group={groupid}&name={}
+	r.Handle(s.prefix+"/group/deltemplate", requireString("group", "name"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		gid, name := ps["group"], ps["name"]
+		group, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if _, ok := group.GetTemplates()[name]; !ok {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: group %v has no template %v", gid, name)
+			return
+		}
+		if err := group.DeleteTemplate(name); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("group %v delete template %v: %v", gid, name, err)
+			return
+		}
+	})
+	// get group message templates
+	// group={groupid}
+	r.Handle(s.prefix+"/group/templates", requireString("group"), func(c *wsgo.Context) {
+		gid, _ := c.StringParam("group")
+		group, err := s.db.GetGroupByID(gid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		ts := group.GetTemplates()
+		if ts == nil {
+			ts = map[string]database.Template{}
+		}
+		c.Json(http.StatusOK, ts)
+	})
+	// set session output format
+	// session={sessionid}&type={json|template|form|text}&body={}&method={}&fields={}&headers={}
+	r.Handle(s.prefix+"/session/setformat", requireString("session"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid := ps["session"]
+		f := database.Format{Type: ps["type"], Body: ps["body"], Method: strings.ToUpper(ps["method"])}
+		if err := bindParam(c, "fields", &f.Fields); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := bindParam(c, "headers", &f.Headers); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := checkFormat(f); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetFormat(f); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set format: %v", sid, err)
+			return
+		}
+	})
+	// set session channel
+	// session={sessionid}&channel={generic|slack|discord|teams|telegram|email}
+	r.Handle(s.prefix+"/session/setchannel", requireString("session", "channel"), func(c *wsgo.Context) {
+		ps := c.StringParams()
+		sid, channel := ps["session"], ps["channel"]
+		if err := s.checkChannel(channel); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil {
+			err = s.checkHook(channel, session.GetPushHook())
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetChannel(channel); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set channel %v: %v", sid, channel, err)
+			return
+		}
+	})
+	// subscribe a session to topics; an empty list leaves it out of topic pushes
+	// session={sessionid}&topics=[]
+	r.Handle(s.prefix+"/session/settopics", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		topics := []string{}
+		if err := bindParam(c, "topics", &topics); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := checkTopics(topics); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetTopics(topics); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set topics: %v", sid, err)
+			return
+		}
+	})
+	// replace the session tags matched by tag expressions; an empty value makes a bare tag
+	// session={sessionid}&tags={"key": "value"}
+	r.Handle(s.prefix+"/session/settags", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		tags := map[string]string{}
+		if err := bindParam(c, "tags", &tags); err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		l, err := tagList(tags)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		if err := session.SetTags(l); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v set tags: %v", sid, err)
+			return
+		}
+	})
+	// get delivery status
+	// delivery={deliveryid}
+	r.Handle(s.prefix+"/delivery/check", requireString("delivery"), func(c *wsgo.Context) {
+		did, _ := c.StringParam("delivery")
+		d, err := s.db.GetDeliveryByID(did)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		c.Json(http.StatusOK, Delivery{d}.WsgoH())
+	})
+	s.handleList(r)
+	s.handleHooks(r)
+	s.handleVerify(r)
+	s.handleClient(r)
+	s.handleAcks(r)
+	s.handleEscalations(r)
+	s.handleGroupTree(r)
+	s.handleLifecycle(r)
+	s.handleCompat(r)
+	s.handleAlerts(r)
+	s.handleRules(r)
+	s.handleRecurring(r)
 	s.scheduler.Run()
+	go s.purgeLoop()
+	go s.probeLoop()
 	return r.Run(s.addr)
 }
+
+// parsePush reads the message and the optional "when" of a push request, see
+// parseTime; day-times are in loc unless they name a zone. Its errors are
+// meant to be shown to the caller.
+func parsePush(ps map[string]string, loc *time.Location) (m Message, when time.Time, scheduled bool, err error) {
+	m = Message{Author: ps["author"], Title: ps["title"], Content: ps["content"], Topic: ps["topic"]}
+	if m.Priority, err = ParsePriority(ps["priority"]); err != nil {
+		return
+	}
+	if m.tags, err = parseTagExpr(ps["tags"]); err != nil {
+		return
+	}
+	now := time.Now()
+	when = now
+	if w, ok := ps["when"]; ok {
+		if when, err = parseTime(w, now, loc); err != nil {
+			return
+		}
+		if when.Before(now) {
+			err = fmt.Errorf("when %v is in the past", when.Format(time.RFC3339))
+			return
+		}
+		scheduled = true
+	}
+	m.ExpiresAt, err = parseExpiry(ps, when)
+	return
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+)
+
+// checkTagPart rejects keys and values that could not be written in a tag
+// expression.
+func checkTagPart(s string) error {
+	if s == "" || strings.ContainsAny(s, " \t\n()=!&|") {
+		return fmt.Errorf("invalid tag %q", s)
+	}
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT":
+		return fmt.Errorf("invalid tag %q", s)
+	}
+	return nil
+}
+
+// tagList stores tags as sorted "key=value" strings.
+func tagList(tags map[string]string) ([]string, error) {
+	l := []string{}
+	for k, v := range tags {
+		if err := checkTagPart(k); err != nil {
+			return nil, err
+		}
+		if v == "" {
+			l = append(l, k)
+			continue
+		}
+		if err := checkTagPart(v); err != nil {
+			return nil, err
+		}
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return l, nil
+}
+
+func tagMap(tags []string) map[string]string {
+	m := map[string]string{}
+	for _, t := range tags {
+		k, v, _ := strings.Cut(t, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func checkTopics(topics []string) error {
+	for _, t := range topics {
+		if err := checkTagPart(t); err != nil {
+			return fmt.Errorf("invalid topic %q", t)
+		}
+	}
+	return nil
+}
+
+func tokenizeTagExpr(s string) []string {
+	var tokens []string
+	cur := strings.Builder{}
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && cur.Len() == 0 && (i+1 >= len(s) || s[i+1] != '='):
+			tokens = append(tokens, "!")
+		case (c == '&' || c == '|') && i+1 < len(s) && s[i+1] == c:
+			flush()
+			tokens = append(tokens, s[i:i+2])
+			i++
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type tagParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func isTagOp(t string, ops ...string) bool {
+	for _, op := range ops {
+		if strings.EqualFold(t, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *tagParser) or() (database.TagExpr, error) {
+	e, err := p.and()
+	if err != nil {
+		return e, err
+	}
+	args := []database.TagExpr{e}
+	for isTagOp(p.peek(), "OR", "||") {
+		p.pos++
+		e, err := p.and()
+		if err != nil {
+			return e, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return database.TagExpr{Op: database.TagOr, Args: args}, nil
+}
+
+// and also joins adjacent terms, so "env=prod team=db" needs both.
+func (p *tagParser) and() (database.TagExpr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return e, err
+	}
+	args := []database.TagExpr{e}
+	for {
+		t := p.peek()
+		if isTagOp(t, "AND", "&&") {
+			p.pos++
+		} else if t == "" || t == ")" || isTagOp(t, "OR", "||") {
+			break
+		}
+		e, err := p.unary()
+		if err != nil {
+			return e, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return database.TagExpr{Op: database.TagAnd, Args: args}, nil
+}
+
+func (p *tagParser) unary() (database.TagExpr, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t == "":
+		return database.TagExpr{}, fmt.Errorf("unexpected end of tag expression")
+	case isTagOp(t, "NOT", "!"):
+		e, err := p.unary()
+		return database.TagExpr{Op: database.TagNot, Args: []database.TagExpr{e}}, err
+	case t == "(":
+		e, err := p.or()
+		if err != nil {
+			return e, err
+		}
+		if p.peek() != ")" {
+			return e, fmt.Errorf("missing ) in tag expression")
+		}
+		p.pos++
+		return e, nil
+	case t == ")" || isTagOp(t, "AND", "OR", "&&", "||"):
+		return database.TagExpr{}, fmt.Errorf("unexpected %q in tag expression", t)
+	}
+	if k, v, ok := strings.Cut(t, "!="); ok {
+		if checkTagPart(k) != nil || checkTagPart(v) != nil {
+			return database.TagExpr{}, fmt.Errorf("invalid tag term %q", t)
+		}
+		return database.TagExpr{Op: database.TagNot, Args: []database.TagExpr{{Op: database.TagEq, Key: k, Value: v}}}, nil
+	}
+	if k, v, ok := strings.Cut(t, "="); ok {
+		if checkTagPart(k) != nil || checkTagPart(v) != nil {
+			return database.TagExpr{}, fmt.Errorf("invalid tag term %q", t)
+		}
+		return database.TagExpr{Op: database.TagEq, Key: k, Value: v}, nil
+	}
+	if err := checkTagPart(t); err != nil {
+		return database.TagExpr{}, err
+	}
+	return database.TagExpr{Op: database.TagHas, Key: t}, nil
+}
+
+// parseTagExpr parses expressions such as "env=prod AND (team=db OR oncall)".
+// Terms are key=value, key!=value or a bare key; NOT, AND and OR (or !, &&
+// and ||) combine them. An empty expression returns nil.
+func parseTagExpr(s string) (*database.TagExpr, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	p := tagParser{tokens: tokenizeTagExpr(s)}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in tag expression", p.peek())
+	}
+	return &e, nil
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+const defaultTelegramAPI = "https://api.telegram.org"
+
+// telegramChannel sends messages with the Bot API sendMessage method. The
+// session data holds "bot_token", "chat_id" and optionally "parse_mode"
+// ("HTML", the default, "MarkdownV2" or "none"); the hook is not used.
+type telegramChannel struct {
+	apiBase string
+}
+
+type telegramTarget struct {
+	BotToken  string `json:"bot_token"`
+	ChatID    any    `json:"chat_id"`
+	ParseMode string `json:"parse_mode"`
+}
+
+func telegramTargetOf(s Session) (telegramTarget, error) {
+	var t telegramTarget
+	b, err := json.Marshal(s.GetData())
+	if err == nil {
+		err = json.Unmarshal(b, &t)
+	}
+	if err != nil {
+		return t, fmt.Errorf("telegram session data: %v", err)
+	}
+	if t.BotToken == "" || t.ChatID == nil || t.ChatID == "" {
+		return t, fmt.Errorf("telegram session data needs bot_token and chat_id")
+	}
+	switch t.ParseMode {
+	case "":
+		t.ParseMode = "HTML"
+	case "HTML", "MarkdownV2", "none":
+	default:
+		return t, fmt.Errorf("unknown telegram parse_mode: %s", t.ParseMode)
+	}
+	return t, nil
+}
+
+var markdownV2Escaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+	"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// telegramText formats a message for the parse mode, escaping its fields.
+func telegramText(m *Message, mode string) string {
+	var parts []string
+	switch mode {
+	case "HTML":
+		if m.Title != "" {
+			parts = append(parts, "<b>"+html.EscapeString(m.Title)+"</b>")
+		}
+		if m.Content != "" {
+			parts = append(parts, html.EscapeString(m.Content))
+		}
+		if m.Author != "" {
+			parts = append(parts, "<i>"+html.EscapeString(m.Author)+"</i>")
+		}
+	case "MarkdownV2":
+		if m.Title != "" {
+			parts = append(parts, "*"+markdownV2Escaper.Replace(m.Title)+"*")
+		}
+		if m.Content != "" {
+			parts = append(parts, markdownV2Escaper.Replace(m.Content))
+		}
+		if m.Author != "" {
+			parts = append(parts, "_"+markdownV2Escaper.Replace(m.Author)+"_")
+		}
+	default:
+		for _, p := range []string{m.Title, m.Content, m.Author} {
+			if p != "" {
+				parts = append(parts, p)
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// telegramLimit is how long a message may be once its markup is parsed;
+// Telegram counts UTF-16 code units.
+const telegramLimit = 4096
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// truncateUTF16 cuts s on a rune boundary to at most n UTF-16 code units.
+func truncateUTF16(s string, n int) string {
+	for i, r := range s {
+		if n -= utf16.RuneLen(r); n < 0 {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// telegramFit keeps the text of ms within telegramLimit, shortening the
+// first message over it and leaving out the rest. It works on the fields
+// before escaping, as the limit applies to the visible text.
+func telegramFit(ms []*Message) []*Message {
+	left := telegramLimit
+	r := []*Message{}
+	for i, m := range ms {
+		sep := 0
+		if i > 0 {
+			sep = 2
+		}
+		n := sep + utf16Len(telegramText(m, "none"))
+		if n <= left {
+			r = append(r, m)
+			left -= n
+			continue
+		}
+		c := *m
+		// the content, a newline and an ellipsis fill the room the rest leaves
+		room := left - sep - utf16Len(telegramText(&Message{Title: m.Title, Author: m.Author}, "none")) - 2
+		switch {
+		case room > 0 && m.Content != "":
+			c.Content = truncateUTF16(m.Content, room) + "…"
+		case len(r) == 0:
+			c.Title, c.Content, c.Author = truncateUTF16(telegramText(m, "none"), left-1)+"…", "", ""
+		default:
+			return r
+		}
+		return append(r, &c)
+	}
+	return r
+}
+
+func (c telegramChannel) Request(s Session, payload wsgo.H) (request, error) {
+	t, err := telegramTargetOf(s)
+	if err != nil {
+		return request{}, err
+	}
+	ms := payloadMessages(payload)
+	silent := true
+	for _, m := range ms {
+		if m.Priority.Level() > PriorityLow.Level() {
+			silent = false
+		}
+	}
+	var texts []string
+	for _, m := range telegramFit(ms) {
+		texts = append(texts, telegramText(m, t.ParseMode))
+	}
+	body := wsgo.H{"chat_id": t.ChatID, "text": strings.Join(texts, "\n\n"), "disable_notification": silent}
+	if t.ParseMode != "none" {
+		body["parse_mode"] = t.ParseMode
+	}
+	if u, read := payloadAck(payload); u != "" {
+		body["reply_markup"] = wsgo.H{"inline_keyboard": [][]wsgo.H{{
+			{"text": "Acknowledge", "url": u}, {"text": "Mark read", "url": read},
+		}}}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return request{}, err
+	}
+	return request{
+		Method: http.MethodPost,
+		URL:    c.apiBase + "/bot" + t.BotToken + "/sendMessage",
+		Header: map[string]string{"Content-Type": "application/json"},
+		Body:   b,
+	}, nil
+}
+
+// RateLimited reads the retry_after the Bot API sends with 429 responses.
+func (telegramChannel) RateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	var r struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if json.Unmarshal(body, &r) == nil && r.Parameters.RetryAfter > 0 {
+		return time.Duration(r.Parameters.RetryAfter) * time.Second, true
+	}
+	return rateLimitedStatus(resp)
+}
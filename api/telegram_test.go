@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+func telegramSession(mode string) Session {
+	data := map[string]any{"bot_token": "123:abc", "chat_id": -100200}
+	if mode != "" {
+		data["parse_mode"] = mode
+	}
+	return Session{stubSession{data: data}}
+}
+
+func TestTelegramRequest(t *testing.T) {
+	rcv := newStubReceiver(t, func(w http.ResponseWriter) {
+		w.Write([]byte(`{"ok": true, "result": {}}`))
+	})
+	post(t, telegramChannel{apiBase: rcv.URL}, telegramSession(""), wsgo.H{"message": &Message{
+		Title: "Build <main>", Content: "a & b", Author: "ci", Priority: PriorityLow}})
+	if rcv.paths[0] != "/bot123:abc/sendMessage" {
+		t.Errorf("path = %v", rcv.paths[0])
+	}
+	v := decode(t, rcv.bodies[0])
+	if v["chat_id"] != float64(-100200) || v["parse_mode"] != "HTML" || v["disable_notification"] != true {
+		t.Errorf("body = %v", v)
+	}
+	if want := "<b>Build &lt;main&gt;</b>\na &amp; b\n<i>ci</i>"; v["text"] != want {
+		t.Errorf("text = %q, want %q", v["text"], want)
+	}
+}
+
+func TestTelegramDigestNotifies(t *testing.T) {
+	rcv := newStubReceiver(t, ok)
+	post(t, telegramChannel{apiBase: rcv.URL}, telegramSession("none"), digest(
+		&Message{Title: "one", Priority: PriorityLow},
+		&Message{Title: "two", Content: "*raw*", Priority: PriorityHigh},
+	))
+	v := decode(t, rcv.bodies[0])
+	if _, ok := v["parse_mode"]; ok {
+		t.Errorf("parse_mode = %v, want none", v["parse_mode"])
+	}
+	if v["text"] != "one\n\ntwo\n*raw*" || v["disable_notification"] != false {
+		t.Errorf("body = %v", v)
+	}
+}
+
+func TestTelegramMarkdownV2(t *testing.T) {
+	m := &Message{Title: "v1.2-rc", Content: "50% done (a_b) [x]! `c` #1 {y} ~z~ > | + = \\", Author: "ci_bot"}
+	want := "*v1\\.2\\-rc*\n50% done \\(a\\_b\\) \\[x\\]\\! \\`c\\` \\#1 \\{y\\} \\~z\\~ \\> \\| \\+ \\= \\\\\n_ci\\_bot_"
+	if got := telegramText(m, "MarkdownV2"); got != want {
+		t.Errorf("telegramText = %q, want %q", got, want)
+	}
+}
+
+func TestTelegramSessionData(t *testing.T) {
+	for _, data := range []any{
+		map[string]any{"chat_id": 1},
+		map[string]any{"bot_token": "x"},
+		map[string]any{"bot_token": "x", "chat_id": 1, "parse_mode": "Markdown"},
+	} {
+		if _, err := (telegramChannel{}).Request(Session{stubSession{data: data}}, wsgo.H{}); err == nil {
+			t.Errorf("data %v accepted", data)
+		}
+	}
+}
+
+func TestTelegramLimit(t *testing.T) {
+	rcv := newStubReceiver(t, ok)
+	long := strings.Repeat("a.😀", 2000)
+	post(t, telegramChannel{apiBase: rcv.URL}, telegramSession("MarkdownV2"), digest(
+		&Message{Title: "first", Content: long},
+		&Message{Title: "left out"},
+	))
+	text := decode(t, rcv.bodies[0])["text"].(string)
+	if !utf8.ValidString(text) {
+		t.Fatalf("text cut inside a rune")
+	}
+	if strings.Contains(text, "left out") || !strings.HasSuffix(text, "…") {
+		t.Errorf("text ends %q", text[len(text)-20:])
+	}
+	// the limit applies to the text without markup
+	visible := strings.NewReplacer("\\", "", "*", "").Replace(text)
+	if n := utf16Len(visible); n > telegramLimit {
+		t.Errorf("visible text has %d UTF-16 units, limit %d", n, telegramLimit)
+	}
+}
+
+func TestTelegramRetryAfter(t *testing.T) {
+	rcv := newStubReceiver(t, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 12", "parameters": {"retry_after": 12}}`))
+	})
+	srv, entries := testServer()
+	srv.SetTelegramAPI(rcv.URL)
+	start := time.Now()
+	if err := sendOnce(t, srv, ChannelTelegram, telegramSession(""), &Message{Title: "x", Priority: PriorityNormal}); err == nil {
+		t.Fatal("send succeeded on 429")
+	}
+	job, at := rescheduled(t, entries)
+	if job.limited != 1 {
+		t.Errorf("limited = %d, want 1", job.limited)
+	}
+	if d := at.Sub(start); d < 12*time.Second || d > 13*time.Second {
+		t.Errorf("retry in %v, want 12s", d)
+	}
+	if job.req.URL != rcv.URL+"/bot123:abc/sendMessage" {
+		t.Errorf("retry url = %v", job.req.URL)
+	}
+}
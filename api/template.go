@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// messageTemplate renders the fields of a message for each recipient. The
+// templates see .session, .group and .message (id and data, or the pushed
+// fields) and the .vars of the push request. .group is the group pushed to,
+// or the group of the session for session pushes.
+type messageTemplate struct {
+	author  *template.Template
+	title   *template.Template
+	content *template.Template
+	vars    any
+	group   database.Group
+}
+
+func checkTemplateName(name string) error {
+	if name == "" || strings.ContainsAny(name, ".$") {
+		return fmt.Errorf("invalid template name: %q", name)
+	}
+	return nil
+}
+
+func parseMessageTemplate(t database.Template) (*messageTemplate, error) {
+	parse := func(name string, src string) (*template.Template, error) {
+		if src == "" {
+			return nil, nil
+		}
+		r, err := template.New(name).Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("template %v: %v", name, err)
+		}
+		return r, nil
+	}
+	var mt messageTemplate
+	var err error
+	if mt.author, err = parse("author", t.Author); err != nil {
+		return nil, err
+	}
+	if mt.title, err = parse("title", t.Title); err != nil {
+		return nil, err
+	}
+	if mt.content, err = parse("content", t.Content); err != nil {
+		return nil, err
+	}
+	return &mt, nil
+}
+
+// pushTemplate attaches the template of a push request to m: the group
+// template named by "template", or the pushed fields themselves if "render"
+// is set. g may be nil for sessions without a group.
+func pushTemplate(c *wsgo.Context, m *Message, g database.Group) error {
+	var t database.Template
+	if name, ok := c.StringParam("template"); ok {
+		if g == nil {
+			return fmt.Errorf("template %q needs a group", name)
+		}
+		if t, ok = g.GetTemplates()[name]; !ok {
+			return fmt.Errorf("group %v has no template %q", g.GetID(), name)
+		}
+	} else if boolParam(c, "render") {
+		t = database.Template{Author: m.Author, Title: m.Title, Content: m.Content}
+	} else {
+		return nil
+	}
+	mt, err := parseMessageTemplate(t)
+	if err != nil {
+		return err
+	}
+	mt.vars, _ = c.Param("vars")
+	m.template = mt
+	return nil
+}
+
+// pushedTo returns m rendering .group as g.
+func (m *Message) pushedTo(g database.Group) *Message {
+	if m.template == nil {
+		return m
+	}
+	mt := *m.template
+	mt.group = g
+	r := *m
+	r.template = &mt
+	return &r
+}
+
+// render returns m with its template executed for the session.
+func (s Session) render(m *Message) (*Message, error) {
+	if m.template == nil {
+		return m, nil
+	}
+	data := wsgo.H{
+		"session": wsgo.H{"id": s.GetID(), "data": s.GetData()},
+		"message": wsgo.H{"author": m.Author, "title": m.Title, "content": m.Content, "priority": m.Priority},
+		"vars":    m.template.vars,
+	}
+	if g := m.template.group; g != nil {
+		data["group"] = wsgo.H{"id": g.GetID(), "data": g.GetData()}
+	} else if g, err := s.GetGroup(); err == nil {
+		data["group"] = wsgo.H{"id": g.GetID(), "data": g.GetData()}
+	}
+	r := *m
+	r.template = nil
+	exec := func(t *template.Template, field *string) error {
+		if t == nil {
+			return nil
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return fmt.Errorf("render %v: %v", t.Name(), err)
+		}
+		*field = b.String()
+		return nil
+	}
+	if err := exec(m.template.author, &r.Author); err != nil {
+		return nil, err
+	}
+	if err := exec(m.template.title, &r.Title); err != nil {
+		return nil, err
+	}
+	if err := exec(m.template.content, &r.Content); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -1,21 +1,68 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/turbitcat/tbcpusher/v2/database"
-	"github.com/turbitcat/tbcpusher/v2/scheduler"
 	"github.com/turbitcat/tbcpusher/v2/wsgo"
 )
 
 type Message struct {
-	Author  string
-	Title   string
-	Content string
+	Author    string
+	Title     string
+	Content   string
+	Priority  Priority
+	ExpiresAt int64  `json:",omitempty"`
+	Topic     string `json:",omitempty"`
+	template  *messageTemplate
+	tags      *database.TagExpr
+	// escalation marks messages sent by an escalation step, which do not
+	// start another one
+	escalation bool
+}
+
+var ErrExpired = errors.New("message expired")
+
+// ErrUnverified is returned for pushes to a session whose hook is not verified yet.
+var ErrUnverified = errors.New("session hook not verified")
+
+// expired reports whether the message is no longer worth delivering at t.
+func (m *Message) expired(t time.Time) bool {
+	return m.ExpiresAt != 0 && t.UnixMilli() >= m.ExpiresAt
+}
+
+// parseExpiry reads the expires_at (Unix milliseconds) and ttl (a duration or
+// seconds, counted from base) params. The earlier one wins; 0 means no expiry.
+func parseExpiry(ps map[string]string, base time.Time) (int64, error) {
+	var r int64
+	if v, ok := ps["expires_at"]; ok {
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expires_at: %v", err)
+		}
+		r = t
+	}
+	if v, ok := ps["ttl"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			sec, err2 := strconv.ParseInt(v, 10, 64)
+			if err2 != nil {
+				return 0, fmt.Errorf("invalid ttl: %v", err)
+			}
+			d = time.Duration(sec) * time.Second
+		}
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid ttl: %v", v)
+		}
+		if t := base.Add(d).UnixMilli(); r == 0 || t < r {
+			r = t
+		}
+	}
+	return r, nil
 }
 
 type Group struct {
@@ -27,7 +74,10 @@ type Session struct {
 }
 
 func (s Session) WsgoH() wsgo.H {
-	return wsgo.H{"id": s.GetID(), "data": s.GetData(), "hook": s.GetPushHook(), "groupID": s.GetGroupID()}
+	return wsgo.H{"id": s.GetID(), "data": s.GetData(), "hook": s.GetPushHook(), "groupID": s.GetGroupID(),
+		"timezone": s.GetTimezone(), "quiet": s.GetQuietHours(), "digest": s.GetDigest(), "format": s.GetFormat(),
+		"channel": s.GetChannel(), "topics": s.GetTopics(), "tags": tagMap(s.GetTags()),
+		"groups": s.GetGroupIDs(), "hidden": s.IsHidden(), "verification": s.GetVerification()}
 }
 
 func (s Session) WsgoHWithGroup() wsgo.H {
@@ -39,28 +89,71 @@ func (s Session) WsgoHWithGroup() wsgo.H {
 	return r
 }
 
-func (s Session) Push(m *Message) (*http.Response, error) {
-	url := s.GetPushHook()
-	data := wsgo.H{"session": s.WsgoHWithGroup(), "message": m}
-	json_data, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("session push: %v", err)
+// Push renders m for the session, sends it to the session hook right away and
+// records the outcome as a delivery. Sessions whose hook is still being verified
+// get nothing (ErrUnverified). Sessions with a digest queue all but critical messages for the
+// next batch (ErrBatched). Inside quiet hours the message is deferred to the end of the
+// window (ErrDeferred) or dropped (ErrDropped), unless its priority bypasses
+// them. Failed deliveries are retried later according to the message priority,
+// and while the session circuit breaker is open they wait or are dropped
+// (ErrCircuitOpen).
+func (s Session) Push(m *Message, srv *Server) pushResp {
+	r := pushResp{Session: &s}
+	if s.GetVerification().State == database.VerificationPending {
+		r.Err = ErrUnverified
+		return r
+	}
+	m, r.Err = s.render(m)
+	if r.Err != nil {
+		return r
+	}
+	r.Delivery, r.Err = s.NewDelivery(m, DeliveryPending)
+	if r.Err != nil {
+		r.Err = fmt.Errorf("session push: %v", r.Err)
+		return r
+	}
+	now := time.Now()
+	if m.expired(now) {
+		srv.setDeliveryStatus(r.Delivery, DeliveryExpired, "")
+		r.Err = ErrExpired
+		return r
+	}
+	if digestEnabled(s.GetDigest()) && m.Priority != PriorityCritical {
+		if r.Err = s.addToDigest(m, srv, r.Delivery); r.Err == nil {
+			r.Err = ErrBatched
+		}
+		return r
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(json_data))
+	if !s.quietUntil(now).IsZero() && !m.Priority.bypassesQuiet() {
+		if r.Err = s.schedule(m, now, srv, r.Delivery); r.Err == nil {
+			r.Err = ErrDeferred
+		}
+		return r
+	}
+	req, err := s.request(srv, wsgo.H{"session": s.WsgoHWithGroup(), "message": m, "ack": srv.ackInfo(r.Delivery)})
 	if err != nil {
-		err = fmt.Errorf("session push: %v", err)
+		srv.setDeliveryStatus(r.Delivery, DeliveryFailed, err.Error())
+		r.Err = fmt.Errorf("session push: %v", err)
+		return r
+	}
+	job := NewPushToSessionJob(req, m, r.Delivery)
+	job.bind(srv)
+	r.Resp, r.Err = job.send()
+	if r.Err != nil {
+		r.Err = fmt.Errorf("session push: %w", r.Err)
 	}
-	return resp, err
+	return r
 }
 
 type pushResp struct {
-	Session *Session
-	Resp    *http.Response
-	Err     error
+	Session  *Session
+	Delivery string
+	Resp     *http.Response
+	Err      error
 }
 
 func (g Group) WsgoH() wsgo.H {
-	return wsgo.H{"id": g.GetID(), "data": g.GetData()}
+	return wsgo.H{"id": g.GetID(), "data": g.GetData(), "parent": g.GetParentID()}
 }
 
 func (g Group) WsgoHWithSessions() wsgo.H {
@@ -76,39 +169,87 @@ func (g Group) WsgoHWithSessions() wsgo.H {
 	return r
 }
 
-func (g Group) Push(m *Message) ([]pushResp, error) {
-	sessions, err := g.GetSessions()
+// Push sends m once to every session of the group and its descendants that is
+// subscribed to the message topic and matches its tag expression. Critical
+// messages start the group escalation policy.
+func (g Group) Push(m *Message, srv *Server) ([]pushResp, error) {
+	sessions, err := g.FindSessions(m.Topic, m.tags)
 	if err != nil {
 		return nil, err
 	}
 	l := []pushResp{}
+	deliveries := []string{}
+	pushed := m.pushedTo(g.Group)
 	for _, s := range sessions {
-		res, err := Session{s}.Push(m)
-		l = append(l, pushResp{&Session{s}, res, err})
+		r := Session{s}.Push(pushed, srv)
+		l = append(l, r)
+		if r.Delivery != "" {
+			deliveries = append(deliveries, r.Delivery)
+		}
+	}
+	if m.Priority == PriorityCritical && !m.escalation {
+		srv.startEscalation(g, m, deliveries, time.Now())
 	}
 	return l, nil
 }
 
-func (s Session) PushWhen(m *Message, t time.Time, sc *scheduler.Scheduler) error {
-	url := s.GetPushHook()
-	data := wsgo.H{"session": s.WsgoHWithGroup(), "message": m}
-	json_data, err := json.Marshal(data)
+// PushWhen schedules m for the session at t and returns the delivery id.
+func (s Session) PushWhen(m *Message, t time.Time, srv *Server) (string, error) {
+	if s.GetVerification().State == database.VerificationPending {
+		return "", ErrUnverified
+	}
+	m, err := s.render(m)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.NewDelivery(m, DeliveryPending)
+	if err != nil {
+		return "", fmt.Errorf("session pushWhen: %v", err)
+	}
+	return id, s.schedule(m, t, srv, id)
+}
+
+// schedule adds a job delivering m at t, or at the end of the quiet hours
+// around t, and records it in the delivery.
+func (s Session) schedule(m *Message, t time.Time, srv *Server, delivery string) error {
+	status := DeliveryScheduled
+	if until := s.quietUntil(t); !until.IsZero() && !m.Priority.bypassesQuiet() {
+		if s.GetQuietHours().Action == QuietDrop || m.Priority.dropsInQuiet() {
+			srv.setDeliveryStatus(delivery, DeliveryDropped, ErrDropped.Error())
+			return ErrDropped
+		}
+		t, status = until, DeliveryDeferred
+	}
+	if m.expired(t) {
+		srv.setDeliveryStatus(delivery, DeliveryExpired, "")
+		return ErrExpired
+	}
+	req, err := s.request(srv, wsgo.H{"session": s.WsgoHWithGroup(), "message": m, "ack": srv.ackInfo(delivery)})
 	if err != nil {
+		srv.setDeliveryStatus(delivery, DeliveryFailed, err.Error())
 		return fmt.Errorf("session pushWhen: %v", err)
 	}
-	job := NewPushToSessionJob(url, json_data)
-	ti := NewOneTimeSchedule(t)
-	sc.AddJob(job, ti)
+	job := NewPushToSessionJob(req, m, delivery)
+	job.bind(srv)
+	srv.scheduler.AddJob(job, NewOneTimeSchedule(t))
+	srv.setDeliveryStatus(delivery, status, t.Format(time.RFC3339))
 	return nil
 }
 
-func (g Group) PushWhen(m *Message, t time.Time, sc *scheduler.Scheduler) error {
-	sessions, err := g.GetSessions()
+func (g Group) PushWhen(m *Message, t time.Time, srv *Server) error {
+	sessions, err := g.FindSessions(m.Topic, m.tags)
 	if err != nil {
 		return fmt.Errorf("group pushWhen: %v", err)
 	}
+	deliveries := []string{}
+	pushed := m.pushedTo(g.Group)
 	for _, s := range sessions {
-		Session{s}.PushWhen(m, t, sc)
+		if d, _ := (Session{s}).PushWhen(pushed, t, srv); d != "" {
+			deliveries = append(deliveries, d)
+		}
+	}
+	if m.Priority == PriorityCritical && !m.escalation {
+		srv.startEscalation(g, m, deliveries, t)
 	}
 	return nil
 }
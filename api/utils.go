@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// bindParam decodes the JSON param k into v. A missing param leaves v untouched.
+func bindParam(c *wsgo.Context, k string, v any) error {
+	p, ok := c.Param(k)
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// intValue converts the numeric types found in decoded bson and JSON to int.
+func intValue(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// intParam reads the param k given either as a JSON number or a string.
+func intParam(c *wsgo.Context, k string) (int, bool, error) {
+	p, ok := c.Param(k)
+	if !ok {
+		return 0, false, nil
+	}
+	if s, isString := p.(string); isString {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, true, fmt.Errorf("invalid %v: %v", k, err)
+		}
+		return n, true, nil
+	}
+	n, isInt := intValue(p)
+	if !isInt {
+		return 0, true, fmt.Errorf("invalid %v: %v", k, p)
+	}
+	return n, true, nil
+}
+
+// boolParam reports whether the param k is true, given as a JSON bool or a string.
+func boolParam(c *wsgo.Context, k string) bool {
+	switch v := c.DefaultParam(k, false).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
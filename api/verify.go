@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/database"
+	"github.com/turbitcat/tbcpusher/v2/wsgo"
+)
+
+// DefaultVerifyWindow is how long a hook verification challenge stays valid.
+const DefaultVerifyWindow = 24 * time.Hour
+
+const AuditVerify = "verify"
+
+// SetVerifyHooks makes every new hook go through the verification handshake.
+func (s *Server) SetVerifyHooks(v bool) {
+	s.verifyHooks = v
+}
+
+// SetPublicURL sets the address the server is reached at from outside, used
+// for confirm links.
+func (s *Server) SetPublicURL(u string) {
+	for len(u) > 0 && u[len(u)-1] == '/' {
+		u = u[:len(u)-1]
+	}
+	s.publicURL = u
+}
+
+func (s *Server) confirmURL(session string, challenge string) string {
+	if s.publicURL == "" {
+		return ""
+	}
+	return s.publicURL + s.prefix + "/session/verify?" + url.Values{"session": {session}, "challenge": {challenge}}.Encode()
+}
+
+// echoes tells if a hook response body repeats the challenge, either as the
+// whole body or as the challenge field of a JSON object.
+func echoes(body []byte, challenge string) bool {
+	if string(bytes.TrimSpace(body)) == challenge {
+		return true
+	}
+	var v struct {
+		Challenge string `json:"challenge"`
+	}
+	return json.Unmarshal(body, &v) == nil && v.Challenge == challenge
+}
+
+// challenge starts the verification of hook for the session. Generic hooks get
+// the challenge posted and are verified at once if they echo it; other
+// channels get a message with the confirm link. With pending the session gets
+// no pushes until verified, otherwise it keeps its current hook meanwhile.
+// It returns the resulting verification state.
+func (s *Server) challenge(c *wsgo.Context, session database.Session, hook string, pending bool) (string, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	old := session.GetVerification()
+	v := database.Verification{State: old.State, Token: hex.EncodeToString(b), Hook: hook,
+		Expires: time.Now().Add(DefaultVerifyWindow)}
+	if pending {
+		v.State = database.VerificationPending
+	}
+	if err := session.SetVerification(v); err != nil {
+		return "", err
+	}
+	link := s.confirmURL(session.GetID(), v.Token)
+	var err error
+	if ch := session.GetChannel(); ch == "" || ch == ChannelGeneric {
+		var body []byte
+		body, err = json.Marshal(wsgo.H{"type": "verification", "session": session.GetID(), "challenge": v.Token,
+			"confirm_url": link})
+		if err == nil {
+			r := request{Session: session.GetID(), Channel: ch, Method: http.MethodPost, URL: hook,
+				Header: map[string]string{"Content-Type": "application/json"}, Body: body}
+			var resp *http.Response
+			var client *http.Client
+			if client, err = s.sessionClient(session); err == nil {
+				resp, body, err = r.do(client)
+			}
+			if err == nil && !delivered(resp) {
+				err = fmt.Errorf("hook responded %v", resp.Status)
+			}
+			if err == nil && echoes(body, v.Token) {
+				return database.VerificationVerified, s.confirm(c, session)
+			}
+		}
+	} else if link == "" {
+		err = fmt.Errorf("%v hooks are confirmed by link, but no public url is set", ch)
+	} else {
+		err = s.notify(session, hook, &Message{Author: "tbcpusher", Title: "Confirm hook",
+			Content: "Open " + link + " to confirm this hook for session " + session.GetID(), Priority: PriorityLow})
+	}
+	if err != nil && !pending {
+		session.SetVerification(old)
+	}
+	return database.VerificationPending, err
+}
+
+// confirm completes the verification, switching to the pending hook.
+func (s *Server) confirm(c *wsgo.Context, session database.Session) error {
+	v := session.GetVerification()
+	if from := session.GetPushHook(); v.Hook != "" && v.Hook != from {
+		if err := session.SetPushHook(v.Hook); err != nil {
+			return err
+		}
+		s.audit(c, session.GetID(), AuditSetHook, from, v.Hook)
+	}
+	if err := session.SetVerification(database.Verification{State: database.VerificationVerified}); err != nil {
+		return err
+	}
+	s.audit(c, session.GetID(), AuditVerify, "", session.GetPushHook())
+	return nil
+}
+
+func (s *Server) handleVerify(r *wsgo.ServerMux) {
+	// confirm a hook with the challenge it got; also the target of confirm links
+	// session={sessionid}&challenge={}
+	r.Handle(s.prefix+"/session/verify", func(c *wsgo.Context) {
+		form := formParams(c)
+		sid, token := firstValue(c, form, "session"), firstValue(c, form, "challenge")
+		session, err := s.db.GetSessionByID(sid)
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		v := session.GetVerification()
+		if v.Token == "" || token != v.Token || time.Now().After(v.Expires) {
+			c.String(http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			c.Log("session %v verify: invalid or expired challenge", sid)
+			return
+		}
+		if err := s.confirm(c, session); err != nil {
+			c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			c.Log("session %v verify: %v", sid, err)
+			return
+		}
+		c.Json(http.StatusOK, wsgo.H{"verification": database.VerificationVerified})
+	})
+	// send a new challenge to the hook waiting for verification
+	// session={sessionid}
+	r.Handle(s.prefix+"/session/verify/resend", requireString("session"), func(c *wsgo.Context) {
+		sid, _ := c.StringParam("session")
+		session, err := s.db.GetSessionByID(sid)
+		if err == nil && session.GetVerification().Token == "" {
+			err = fmt.Errorf("session %v has no hook to verify", sid)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			c.Log("Bad Request: %v", err)
+			return
+		}
+		v := session.GetVerification()
+		state, err := s.challenge(c, session, v.Hook, v.State == database.VerificationPending)
+		if err != nil {
+			c.String(http.StatusFailedDependency, http.StatusText(http.StatusFailedDependency))
+			c.Log("session %v verify hook: %v", sid, err)
+			return
+		}
+		c.Json(http.StatusOK, wsgo.H{"verification": state})
+	})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		weekdays[name], weekdays[name[:3]] = d, d
+	}
+}
+
+// parseTime reads a time given as Unix milliseconds, an RFC 3339 timestamp, a
+// duration from now ("+15m", "in 2h") or a day-time such as "09:00",
+// "tomorrow 09:00 Europe/Berlin", "monday 18:30" or "2026-11-02 09:00 UTC".
+// Day-times are in loc unless they name a zone, and a bare time of day is its
+// next occurrence.
+func parseTime(v string, now time.Time, loc *time.Location) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	lower := strings.ToLower(v)
+	if strings.HasPrefix(lower, "+") || strings.HasPrefix(lower, "in ") {
+		s := strings.TrimPrefix(strings.TrimPrefix(lower, "+"), "in ")
+		d, err := time.ParseDuration(strings.ReplaceAll(s, " ", ""))
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid duration %q", strings.TrimSpace(s))
+		}
+		return now.Add(d), nil
+	}
+	t, err := parseDayTime(strings.Fields(v), now, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %v; use Unix milliseconds, RFC 3339, +15m, in 2h "+
+			"or [today|tomorrow|weekday|2006-01-02] 15:04 [zone]", v, err)
+	}
+	return t, nil
+}
+
+// parseDayTime reads "[day] 15:04 [zone]".
+func parseDayTime(fields []string, now time.Time, loc *time.Location) (time.Time, error) {
+	if n := len(fields); n >= 2 && !strings.Contains(fields[n-1], ":") {
+		l, err := time.LoadLocation(fields[n-1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown zone %q", fields[n-1])
+		}
+		loc, fields = l, fields[:n-1]
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return time.Time{}, fmt.Errorf("expected a day and a time")
+	}
+	clock, err := parseClock(fields[len(fields)-1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	n := now.In(loc)
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, clock/60, clock%60, 0, 0, loc)
+	}
+	t := at(n.Year(), n.Month(), n.Day())
+	if len(fields) == 1 {
+		if !t.After(now) {
+			t = at(n.Year(), n.Month(), n.Day()+1)
+		}
+		return t, nil
+	}
+	day := strings.ToLower(fields[0])
+	if wd, ok := weekdays[day]; ok {
+		ahead := (int(wd) - int(n.Weekday()) + 7) % 7
+		if t = at(n.Year(), n.Month(), n.Day()+ahead); !t.After(now) {
+			t = at(n.Year(), n.Month(), n.Day()+ahead+7)
+		}
+		return t, nil
+	}
+	switch day {
+	case "today":
+		return t, nil
+	case "tomorrow":
+		return at(n.Year(), n.Month(), n.Day()+1), nil
+	}
+	d, err := time.ParseInLocation("2006-01-02", fields[0], loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unknown day %q", fields[0])
+	}
+	return at(d.Year(), d.Month(), d.Day()), nil
+}
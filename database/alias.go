@@ -0,0 +1,138 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type alias struct {
+	ID      primitive.ObjectID
+	Kind    string
+	Key     string
+	Token   string
+	Group   primitive.ObjectID
+	Session primitive.ObjectID
+	Created time.Time
+}
+
+type aliasBson struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Kind    string             `bson:"kind"`
+	Key     string             `bson:"key"`
+	Token   string             `bson:"token,omitempty"`
+	Group   primitive.ObjectID `bson:"group,omitempty"`
+	Session primitive.ObjectID `bson:"session,omitempty"`
+	Created time.Time          `bson:"created,omitempty"`
+}
+
+func (a aliasBson) toAlias() alias {
+	return alias{ID: a.ID, Kind: a.Kind, Key: a.Key, Token: a.Token, Group: a.Group, Session: a.Session, Created: a.Created}
+}
+
+func (a *alias) GetKind() string {
+	return a.Kind
+}
+
+func (a *alias) GetKey() string {
+	return a.Key
+}
+
+func (a *alias) GetToken() string {
+	return a.Token
+}
+
+func (a *alias) GetGroupID() string {
+	if a.Group.IsZero() {
+		return ""
+	}
+	return a.Group.Hex()
+}
+
+func (a *alias) GetSessionID() string {
+	if a.Session.IsZero() {
+		return ""
+	}
+	return a.Session.Hex()
+}
+
+func (a *alias) GetCreated() time.Time {
+	return a.Created
+}
+
+// aliasIndex keeps keys unique per kind.
+func aliasIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+}
+
+func optionalID(id string) (primitive.ObjectID, error) {
+	if id == "" {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+func (db *MongoDatabase) NewAlias(kind string, key string, token string, group string, session string) error {
+	g, err := optionalID(group)
+	if err != nil {
+		return fmt.Errorf("newAlias invalid group \"%v\": %v", group, err)
+	}
+	s, err := optionalID(session)
+	if err != nil {
+		return fmt.Errorf("newAlias invalid session \"%v\": %v", session, err)
+	}
+	a := aliasBson{Kind: kind, Key: key, Token: token, Group: g, Session: s, Created: time.Now()}
+	if _, err := db.aliasCollection.InsertOne(db.ctx, a); err != nil {
+		return fmt.Errorf("newAlias: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoDatabase) GetAlias(kind string, key string) (Alias, error) {
+	r := db.aliasCollection.FindOne(db.ctx, bson.M{"kind": kind, "key": key})
+	a := aliasBson{}
+	if err := r.Decode(&a); err != nil {
+		return nil, fmt.Errorf("getAlias: %v", err)
+	}
+	alias := a.toAlias()
+	return &alias, nil
+}
+
+func (db *MongoDatabase) GetAliases(kind string) ([]Alias, error) {
+	filter := bson.M{}
+	if kind != "" {
+		filter["kind"] = kind
+	}
+	cur, err := db.aliasCollection.Find(db.ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("getAliases: %v", err)
+	}
+	var as []aliasBson
+	if err := cur.All(db.ctx, &as); err != nil {
+		return nil, fmt.Errorf("getAliases: %v", err)
+	}
+	r := []Alias{}
+	for _, a := range as {
+		alias := a.toAlias()
+		r = append(r, &alias)
+	}
+	return r, nil
+}
+
+func (db *MongoDatabase) DeleteAlias(kind string, key string) error {
+	r, err := db.aliasCollection.DeleteOne(db.ctx, bson.M{"kind": kind, "key": key})
+	if err != nil {
+		return fmt.Errorf("deleteAlias: %v", err)
+	}
+	if r.DeletedCount == 0 {
+		return fmt.Errorf("deleteAlias: %v", mongo.ErrNoDocuments)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func auditIndex() mongo.IndexModel {
+	return mongo.IndexModel{Keys: bson.D{{Key: "session", Value: 1}, {Key: "time", Value: -1}}}
+}
+
+func (db *MongoDatabase) NewAudit(a Audit) error {
+	if _, err := db.auditCollection.InsertOne(db.ctx, a); err != nil {
+		return fmt.Errorf("newAudit: %v", err)
+	}
+	return nil
+}
+
+// GetAudit returns the latest changes of a session, newest first.
+func (db *MongoDatabase) GetAudit(session string, limit int) ([]Audit, error) {
+	opts := options.Find().SetSort(bson.M{"time": -1}).SetLimit(int64(limit))
+	cur, err := db.auditCollection.Find(db.ctx, bson.M{"session": session}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("getAudit: %v", err)
+	}
+	l := []Audit{}
+	if err := cur.All(db.ctx, &l); err != nil {
+		return nil, fmt.Errorf("getAudit: %v", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type delivery struct {
+	ID      primitive.ObjectID
+	Session primitive.ObjectID
+	Message any
+	Status  string
+	Detail  string
+	Created time.Time
+	Updated time.Time
+	Acked   time.Time
+	Read    time.Time
+	db      *MongoDatabase
+}
+
+type deliveryBson struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Session primitive.ObjectID `bson:"session,omitempty"`
+	Message bson.M             `bson:"message,omitempty"`
+	Status  string             `bson:"status,omitempty"`
+	Detail  string             `bson:"detail,omitempty"`
+	Created time.Time          `bson:"created,omitempty"`
+	Updated time.Time          `bson:"updated,omitempty"`
+	Acked   time.Time          `bson:"acked,omitempty"`
+	Read    time.Time          `bson:"read,omitempty"`
+}
+
+func (d deliveryBson) toDelivery(db *MongoDatabase) delivery {
+	return delivery{ID: d.ID, Session: d.Session, Message: d.Message["Value"], Status: d.Status, Detail: d.Detail,
+		Created: d.Created, Updated: d.Updated, Acked: d.Acked, Read: d.Read, db: db}
+}
+
+func (d *delivery) GetID() string {
+	return d.ID.Hex()
+}
+
+func (d *delivery) GetSessionID() string {
+	return d.Session.Hex()
+}
+
+func (d *delivery) GetMessage() any {
+	return d.Message
+}
+
+func (d *delivery) GetStatus() string {
+	return d.Status
+}
+
+func (d *delivery) GetDetail() string {
+	return d.Detail
+}
+
+func (d *delivery) GetCreated() time.Time {
+	return d.Created
+}
+
+func (d *delivery) GetUpdated() time.Time {
+	return d.Updated
+}
+
+func (d *delivery) GetAckedAt() time.Time {
+	return d.Acked
+}
+
+func (d *delivery) GetReadAt() time.Time {
+	return d.Read
+}
+
+// Ack records that the message was read at t and, unless readOnly, also
+// acknowledged. Only the first time counts.
+func (d *delivery) Ack(t time.Time, readOnly bool) error {
+	fields := []string{"read"}
+	if !readOnly {
+		fields = append(fields, "acked")
+	}
+	for _, f := range fields {
+		filter := bson.M{"_id": d.ID, f: bson.M{"$exists": false}}
+		if _, err := d.db.deliveryCollection.UpdateOne(d.db.ctx, filter, bson.M{"$set": bson.M{f: t}}); err != nil {
+			return fmt.Errorf("delivery ack: %v", err)
+		}
+	}
+	if d.Read.IsZero() {
+		d.Read = t
+	}
+	if !readOnly && d.Acked.IsZero() {
+		d.Acked = t
+	}
+	return nil
+}
+
+func (d *delivery) SetStatus(status string, detail string) error {
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"status": status, "detail": detail, "updated": now}}
+	if _, err := d.db.deliveryCollection.UpdateByID(d.db.ctx, d.ID, update); err != nil {
+		return fmt.Errorf("delivery setStatus: %v", err)
+	}
+	d.Status, d.Detail, d.Updated = status, detail, now
+	return nil
+}
+
+func (s *session) NewDelivery(message any, status string) (string, error) {
+	db := s.db
+	now := time.Now()
+	d := deliveryBson{Session: s.ID, Message: bson.M{"Value": message}, Status: status, Created: now, Updated: now}
+	r, err := db.deliveryCollection.InsertOne(db.ctx, d)
+	if err != nil {
+		return "", fmt.Errorf("newDelivery: %v", err)
+	}
+	id := (r.InsertedID).(primitive.ObjectID)
+	return id.Hex(), nil
+}
+
+func (db *MongoDatabase) GetDeliveryByID(id string) (Delivery, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("getDeliveryByID invalid id \"%v\": %v", id, err)
+	}
+	r := db.deliveryCollection.FindOne(db.ctx, bson.M{"_id": _id})
+	d := deliveryBson{}
+	if err := r.Decode(&d); err != nil {
+		return nil, fmt.Errorf("getDeliveryByID: %v", err)
+	}
+	delivery := d.toDelivery(db)
+	return &delivery, nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (g *group) GetEscalationPolicy() EscalationPolicy {
+	return g.Escalation
+}
+
+func (g *group) SetEscalationPolicy(p EscalationPolicy) error {
+	if err := setSomethingById(g.db.ctx, g.db.groupCollection, g.ID, "escalation", p); err != nil {
+		return fmt.Errorf("group setEscalationPolicy: %v", err)
+	}
+	g.Escalation = p
+	return nil
+}
+
+type escalationBson struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Escalation `bson:",inline"`
+}
+
+func (e escalationBson) toEscalation() Escalation {
+	r := e.Escalation
+	r.ID = e.ID.Hex()
+	return r
+}
+
+func escalationIndex() mongo.IndexModel {
+	return mongo.IndexModel{Keys: bson.D{{Key: "group", Value: 1}, {Key: "created", Value: -1}}}
+}
+
+func (db *MongoDatabase) NewEscalation(e Escalation) (string, error) {
+	r, err := db.escalationCollection.InsertOne(db.ctx, escalationBson{Escalation: e})
+	if err != nil {
+		return "", fmt.Errorf("newEscalation: %v", err)
+	}
+	id := (r.InsertedID).(primitive.ObjectID)
+	return id.Hex(), nil
+}
+
+func (db *MongoDatabase) GetEscalationByID(id string) (Escalation, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Escalation{}, fmt.Errorf("getEscalationByID invalid id \"%v\": %v", id, err)
+	}
+	r := escalationBson{}
+	if err := db.escalationCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&r); err != nil {
+		return Escalation{}, fmt.Errorf("getEscalationByID: %v", err)
+	}
+	return r.toEscalation(), nil
+}
+
+// GetEscalations returns the latest escalations of a group, all groups if
+// empty, newest first. A non-empty status selects only those in it.
+func (db *MongoDatabase) GetEscalations(group string, status string, limit int) ([]Escalation, error) {
+	filter := bson.M{}
+	if group != "" {
+		filter["group"] = group
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.M{"created": -1}).SetLimit(int64(limit))
+	cur, err := db.escalationCollection.Find(db.ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("getEscalations: %v", err)
+	}
+	var es []escalationBson
+	if err := cur.All(db.ctx, &es); err != nil {
+		return nil, fmt.Errorf("getEscalations: %v", err)
+	}
+	return Map(es, escalationBson.toEscalation), nil
+}
+
+// UpdateActiveEscalation saves the progress of an escalation unless it is no
+// longer active, and tells if it was saved.
+func (db *MongoDatabase) UpdateActiveEscalation(e Escalation) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(e.ID)
+	if err != nil {
+		return false, fmt.Errorf("updateActiveEscalation invalid id \"%v\": %v", e.ID, err)
+	}
+	set := bson.M{"deliveries": e.Deliveries, "step": e.Step, "status": e.Status, "updated": e.Updated}
+	unset := bson.M{}
+	if e.Next.IsZero() {
+		unset["next"] = ""
+	} else {
+		set["next"] = e.Next
+	}
+	if e.Entry == "" {
+		unset["entry"] = ""
+	} else {
+		set["entry"] = e.Entry
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	r, err := db.escalationCollection.UpdateOne(db.ctx, bson.M{"_id": _id, "status": EscalationActive}, update)
+	if err != nil {
+		return false, fmt.Errorf("updateActiveEscalation: %v", err)
+	}
+	return r.MatchedCount > 0, nil
+}
+
+// AnyAcked tells if one of the deliveries has been acknowledged.
+func (db *MongoDatabase) AnyAcked(deliveries []string) (bool, error) {
+	ids := []primitive.ObjectID{}
+	for _, d := range deliveries {
+		if id, err := primitive.ObjectIDFromHex(d); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return false, nil
+	}
+	n, err := db.deliveryCollection.CountDocuments(db.ctx, bson.M{"_id": bson.M{"$in": ids}, "acked": bson.M{"$exists": true}})
+	if err != nil {
+		return false, fmt.Errorf("anyAcked: %v", err)
+	}
+	return n > 0, nil
+}
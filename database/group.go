@@ -2,24 +2,34 @@ package database
 
 import (
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type group struct {
-	ID   primitive.ObjectID
-	Data any
-	db   *MongoDatabase
+	ID         primitive.ObjectID
+	Parent     primitive.ObjectID
+	Data       any
+	Templates  map[string]Template
+	Deleted    time.Time
+	Escalation EscalationPolicy
+	db         *MongoDatabase
 }
 
 type groupBson struct {
-	ID   primitive.ObjectID `bson:"_id,omitempty"`
-	Data bson.M             `bson:"data,omitempty"`
+	ID         primitive.ObjectID  `bson:"_id,omitempty"`
+	Parent     primitive.ObjectID  `bson:"parent,omitempty"`
+	Data       bson.M              `bson:"data,omitempty"`
+	Templates  map[string]Template `bson:"templates,omitempty"`
+	Deleted    time.Time           `bson:"deleted,omitempty"`
+	Escalation EscalationPolicy    `bson:"escalation,omitempty"`
 }
 
 func (g groupBson) toGroup(db *MongoDatabase) group {
-	return group{ID: g.ID, Data: g.Data["Value"], db: db}
+	return group{ID: g.ID, Parent: g.Parent, Data: g.Data["Value"], Templates: g.Templates, Deleted: g.Deleted,
+		Escalation: g.Escalation, db: db}
 }
 
 func (g *group) GetID() string {
@@ -39,7 +49,7 @@ func (g *group) SetData(data any) error {
 
 func (g *group) NewSession(hook string, data any) (string, error) {
 	db := g.db
-	s := sessionBson{Group: g.ID, Hook: hook, Data: bson.M{"Value": data}}
+	s := sessionBson{Group: g.ID, Hook: hook, HookHost: hookHost(hook), Data: bson.M{"Value": data}}
 	r, err := db.sessionCollection.InsertOne(db.ctx, s)
 	if err != nil {
 		return "", fmt.Errorf("newSession: %v", err)
@@ -48,9 +58,12 @@ func (g *group) NewSession(hook string, data any) (string, error) {
 	return id.Hex(), nil
 }
 
+// GetSessions returns the visible sessions of the group, both its own and
+// those added to it.
 func (g *group) GetSessions() ([]Session, error) {
 	db := g.db
-	cur, err := g.db.sessionCollection.Find(db.ctx, bson.M{"group": g.ID})
+	filter := bson.M{"$or": bson.A{bson.M{"group": g.ID}, bson.M{"groups": g.ID}}, "deleted": notDeleted}
+	cur, err := g.db.sessionCollection.Find(db.ctx, filter)
 	if err != nil {
 		return nil, fmt.Errorf("getSessions Find: %v", err)
 	}
@@ -62,3 +75,172 @@ func (g *group) GetSessions() ([]Session, error) {
 	f := func(s sessionBson) Session { r := s.toSession(db); return &r }
 	return Map(l, f), nil
 }
+
+// GetOwnSessions returns the sessions whose group is g, hidden ones included,
+// that are not soft deleted.
+func (g *group) GetOwnSessions() ([]Session, error) {
+	db := g.db
+	cur, err := db.sessionCollection.Find(db.ctx, bson.M{"group": g.ID, "deleted": notDeleted})
+	if err != nil {
+		return nil, fmt.Errorf("getOwnSessions Find: %v", err)
+	}
+	var l []sessionBson
+	if err = cur.All(db.ctx, &l); err != nil {
+		return nil, fmt.Errorf("getOwnSessions All: %v", err)
+	}
+	f := func(s sessionBson) Session { r := s.toSession(db); return &r }
+	return Map(l, f), nil
+}
+
+// FindSessions returns the visible, verified sessions of the group and its descendants,
+// each once, that are subscribed to topic and whose tags match the
+// expression. An empty topic or a nil expression matches all.
+func (g *group) FindSessions(topic string, tags *TagExpr) ([]Session, error) {
+	db := g.db
+	ds, err := g.descendants()
+	if err != nil {
+		return nil, fmt.Errorf("findSessions: %v", err)
+	}
+	ids := bson.A{g.ID}
+	for _, d := range ds {
+		ids = append(ids, d.ID)
+	}
+	and := bson.A{bson.M{"$or": bson.A{bson.M{"group": bson.M{"$in": ids}}, bson.M{"groups": bson.M{"$in": ids}}}}}
+	if tags != nil {
+		q, err := tagQuery(*tags)
+		if err != nil {
+			return nil, fmt.Errorf("findSessions: %v", err)
+		}
+		and = append(and, q)
+	}
+	filter := bson.M{"hide": bson.M{"$ne": true}, "deleted": notDeleted, "verification.state": bson.M{"$ne": VerificationPending},
+		"$and": and}
+	if topic != "" {
+		filter["topics"] = topic
+	}
+	cur, err := db.sessionCollection.Find(db.ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("findSessions Find: %v", err)
+	}
+	var l []sessionBson
+	if err = cur.All(db.ctx, &l); err != nil {
+		return nil, fmt.Errorf("findSessions All: %v", err)
+	}
+	f := func(s sessionBson) Session { r := s.toSession(db); return &r }
+	return Map(l, f), nil
+}
+
+func (g *group) GetParentID() string {
+	if g.Parent.IsZero() {
+		return ""
+	}
+	return g.Parent.Hex()
+}
+
+// SetParentID moves the group under parent, or to the top when parent is empty.
+func (g *group) SetParentID(parent string) error {
+	var update bson.M
+	id := primitive.NilObjectID
+	if parent == "" {
+		update = bson.M{"$unset": bson.M{"parent": ""}}
+	} else {
+		var err error
+		if id, err = primitive.ObjectIDFromHex(parent); err != nil {
+			return fmt.Errorf("group setParent invalid id: %v", err)
+		}
+		update = bson.M{"$set": bson.M{"parent": id}}
+	}
+	r, err := g.db.groupCollection.UpdateByID(g.db.ctx, g.ID, update)
+	if err != nil {
+		return fmt.Errorf("group setParent: %v", err)
+	}
+	if r.MatchedCount != 1 {
+		return fmt.Errorf("group setParent: matched count is %v", r.MatchedCount)
+	}
+	g.Parent = id
+	return nil
+}
+
+func (g *group) children() ([]groupBson, error) {
+	cur, err := g.db.groupCollection.Find(g.db.ctx, bson.M{"parent": g.ID, "deleted": notDeleted})
+	if err != nil {
+		return nil, err
+	}
+	var l []groupBson
+	if err := cur.All(g.db.ctx, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (g *group) GetChildren() ([]Group, error) {
+	l, err := g.children()
+	if err != nil {
+		return nil, fmt.Errorf("getChildren: %v", err)
+	}
+	f := func(c groupBson) Group { r := c.toGroup(g.db); return &r }
+	return Map(l, f), nil
+}
+
+// descendants walks the tree below g breadth first, visiting each group once.
+// Soft deleted groups are left out with the groups below them.
+func (g *group) descendants() ([]groupBson, error) {
+	seen := map[primitive.ObjectID]bool{g.ID: true}
+	var r []groupBson
+	level := bson.A{g.ID}
+	for len(level) > 0 {
+		cur, err := g.db.groupCollection.Find(g.db.ctx, bson.M{"parent": bson.M{"$in": level}, "deleted": notDeleted})
+		if err != nil {
+			return nil, err
+		}
+		var l []groupBson
+		if err := cur.All(g.db.ctx, &l); err != nil {
+			return nil, err
+		}
+		level = bson.A{}
+		for _, c := range l {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				r = append(r, c)
+				level = append(level, c.ID)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (g *group) GetDescendants() ([]Group, error) {
+	l, err := g.descendants()
+	if err != nil {
+		return nil, fmt.Errorf("getDescendants: %v", err)
+	}
+	f := func(c groupBson) Group { r := c.toGroup(g.db); return &r }
+	return Map(l, f), nil
+}
+
+func (g *group) GetTemplates() map[string]Template {
+	return g.Templates
+}
+
+func (g *group) SetTemplate(name string, t Template) error {
+	if err := setSomethingById(g.db.ctx, g.db.groupCollection, g.ID, "templates."+name, t); err != nil {
+		return fmt.Errorf("group setTemplate: %v", err)
+	}
+	if g.Templates == nil {
+		g.Templates = map[string]Template{}
+	}
+	g.Templates[name] = t
+	return nil
+}
+
+func (g *group) DeleteTemplate(name string) error {
+	r, err := g.db.groupCollection.UpdateByID(g.db.ctx, g.ID, bson.M{"$unset": bson.M{"templates." + name: ""}})
+	if err != nil {
+		return fmt.Errorf("group deleteTemplate: %v", err)
+	}
+	if r.MatchedCount != 1 {
+		return fmt.Errorf("group deleteTemplate: matched count is %v", r.MatchedCount)
+	}
+	delete(g.Templates, name)
+	return nil
+}
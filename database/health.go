@@ -0,0 +1,65 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *session) GetHealth() Health {
+	return s.Health
+}
+
+func (s *session) SetHealth(h Health) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "health", h); err != nil {
+		return fmt.Errorf("session setHealth: %v", err)
+	}
+	s.Health = h
+	return nil
+}
+
+// RecordSuccess resets the failure count and closes the circuit breaker. The
+// auto hidden mark is cleared too; callers unhide the session if it was set.
+func (s *session) RecordSuccess(t time.Time) error {
+	update := bson.M{"$set": bson.M{"health.lastSuccess": t},
+		"$unset": bson.M{"health.failures": "", "health.lastError": "", "health.opened": "", "health.nextProbe": "",
+			"health.autoHidden": ""}}
+	if _, err := s.db.sessionCollection.UpdateByID(s.db.ctx, s.ID, update); err != nil {
+		return fmt.Errorf("session recordSuccess: %v", err)
+	}
+	s.Health = Health{LastSuccess: t, LastFailure: s.Health.LastFailure}
+	return nil
+}
+
+// RecordFailure counts a failed delivery and returns the updated health.
+func (s *session) RecordFailure(t time.Time, detail string) (Health, error) {
+	update := bson.M{"$inc": bson.M{"health.failures": 1},
+		"$set": bson.M{"health.lastFailure": t, "health.lastError": detail}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"health": 1})
+	var r struct {
+		Health Health `bson:"health"`
+	}
+	if err := s.db.sessionCollection.FindOneAndUpdate(s.db.ctx, bson.M{"_id": s.ID}, update, opts).Decode(&r); err != nil {
+		return Health{}, fmt.Errorf("session recordFailure: %v", err)
+	}
+	s.Health = r.Health
+	return r.Health, nil
+}
+
+// GetProbeDue returns the sessions with an open circuit breaker due to be
+// probed at t.
+func (db *MongoDatabase) GetProbeDue(t time.Time) ([]Session, error) {
+	filter := bson.M{"health.opened": bson.M{"$exists": true}, "health.nextProbe": bson.M{"$lte": t}, "deleted": notDeleted}
+	cur, err := db.sessionCollection.Find(db.ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("getProbeDue: %v", err)
+	}
+	var l []sessionBson
+	if err := cur.All(db.ctx, &l); err != nil {
+		return nil, fmt.Errorf("getProbeDue: %v", err)
+	}
+	f := func(s sessionBson) Session { r := s.toSession(db); return &r }
+	return Map(l, f), nil
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// notDeleted filters out soft deleted documents.
+var notDeleted = bson.M{"$exists": false}
+
+func (s *session) IsHidden() bool {
+	return s.Hidden
+}
+
+func (s *session) Unhide() error {
+	r, err := s.db.sessionCollection.UpdateByID(s.db.ctx, s.ID, bson.M{"$unset": bson.M{"hide": ""}})
+	if err != nil {
+		return fmt.Errorf("session unhide: %v", err)
+	}
+	if r.MatchedCount != 1 {
+		return fmt.Errorf("session unhide: matched count is %v", r.MatchedCount)
+	}
+	s.Hidden = false
+	return nil
+}
+
+func (s *session) GetDeletedAt() time.Time {
+	return s.Deleted
+}
+
+// SoftDelete marks the session deleted at t. It is kept until purged and
+// can be restored until then.
+func (s *session) SoftDelete(t time.Time) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "deleted", t); err != nil {
+		return fmt.Errorf("session softDelete: %v", err)
+	}
+	s.Deleted = t
+	return nil
+}
+
+func (g *group) GetDeletedAt() time.Time {
+	return g.Deleted
+}
+
+// SoftDelete marks the group deleted at t, and with deleteSessions its own
+// sessions too.
+func (g *group) SoftDelete(t time.Time, deleteSessions bool) error {
+	db := g.db
+	if deleteSessions {
+		filter := bson.M{"group": g.ID, "deleted": notDeleted}
+		if _, err := db.sessionCollection.UpdateMany(db.ctx, filter, bson.M{"$set": bson.M{"deleted": t}}); err != nil {
+			return fmt.Errorf("group softDelete sessions: %v", err)
+		}
+	}
+	if err := setSomethingById(db.ctx, db.groupCollection, g.ID, "deleted", t); err != nil {
+		return fmt.Errorf("group softDelete: %v", err)
+	}
+	g.Deleted = t
+	return nil
+}
+
+// DetachSessions removes every session from the group.
+func (g *group) DetachSessions() error {
+	db := g.db
+	if _, err := db.sessionCollection.UpdateMany(db.ctx, bson.M{"group": g.ID}, bson.M{"$unset": bson.M{"group": ""}}); err != nil {
+		return fmt.Errorf("group detachSessions: %v", err)
+	}
+	if _, err := db.sessionCollection.UpdateMany(db.ctx, bson.M{"groups": g.ID}, bson.M{"$pull": bson.M{"groups": g.ID}}); err != nil {
+		return fmt.Errorf("group detachSessions: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoDatabase) RestoreSession(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("restoreSession invalid id \"%v\": %v", id, err)
+	}
+	r, err := db.sessionCollection.UpdateOne(db.ctx, bson.M{"_id": _id, "deleted": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deleted": ""}})
+	if err != nil {
+		return fmt.Errorf("restoreSession: %v", err)
+	}
+	if r.MatchedCount != 1 {
+		return fmt.Errorf("restoreSession: session %v is not deleted", id)
+	}
+	return nil
+}
+
+// RestoreGroup restores a soft deleted group along with the sessions deleted
+// with it.
+func (db *MongoDatabase) RestoreGroup(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("restoreGroup invalid id \"%v\": %v", id, err)
+	}
+	g := groupBson{}
+	if err := db.groupCollection.FindOne(db.ctx, bson.M{"_id": _id, "deleted": bson.M{"$exists": true}}).Decode(&g); err != nil {
+		return fmt.Errorf("restoreGroup: %v", err)
+	}
+	filter := bson.M{"group": _id, "deleted": g.Deleted}
+	if _, err := db.sessionCollection.UpdateMany(db.ctx, filter, bson.M{"$unset": bson.M{"deleted": ""}}); err != nil {
+		return fmt.Errorf("restoreGroup sessions: %v", err)
+	}
+	if _, err := db.groupCollection.UpdateByID(db.ctx, _id, bson.M{"$unset": bson.M{"deleted": ""}}); err != nil {
+		return fmt.Errorf("restoreGroup: %v", err)
+	}
+	return nil
+}
+
+// PurgeSession removes a session with its deliveries, scheduled entries,
+// recurring pushes, aliases and audit trail.
+func (db *MongoDatabase) PurgeSession(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("purgeSession invalid id \"%v\": %v", id, err)
+	}
+	if _, err := db.scheduleCollection.DeleteMany(db.ctx, bson.M{"job.session": id}); err != nil {
+		return fmt.Errorf("purgeSession entries: %v", err)
+	}
+	if _, err := db.recurringCollection.DeleteMany(db.ctx, bson.M{"session": id}); err != nil {
+		return fmt.Errorf("purgeSession recurrings: %v", err)
+	}
+	if _, err := db.deliveryCollection.DeleteMany(db.ctx, bson.M{"session": _id}); err != nil {
+		return fmt.Errorf("purgeSession deliveries: %v", err)
+	}
+	if _, err := db.aliasCollection.DeleteMany(db.ctx, bson.M{"session": _id}); err != nil {
+		return fmt.Errorf("purgeSession aliases: %v", err)
+	}
+	if _, err := db.auditCollection.DeleteMany(db.ctx, bson.M{"session": id}); err != nil {
+		return fmt.Errorf("purgeSession audits: %v", err)
+	}
+	r, err := db.sessionCollection.DeleteOne(db.ctx, bson.M{"_id": _id})
+	if err != nil {
+		return fmt.Errorf("purgeSession: %v", err)
+	}
+	if r.DeletedCount != 1 {
+		return fmt.Errorf("purgeSession: deleted count is %v", r.DeletedCount)
+	}
+	return nil
+}
+
+// PurgeGroup removes a group with its aliases, rules and recurring pushes.
+// Its children move to its parent and its remaining sessions are detached.
+func (db *MongoDatabase) PurgeGroup(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("purgeGroup invalid id \"%v\": %v", id, err)
+	}
+	g := groupBson{}
+	if err := db.groupCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&g); err != nil {
+		return fmt.Errorf("purgeGroup: %v", err)
+	}
+	update := bson.M{"$unset": bson.M{"parent": ""}}
+	if !g.Parent.IsZero() {
+		update = bson.M{"$set": bson.M{"parent": g.Parent}}
+	}
+	if _, err := db.groupCollection.UpdateMany(db.ctx, bson.M{"parent": _id}, update); err != nil {
+		return fmt.Errorf("purgeGroup children: %v", err)
+	}
+	group := g.toGroup(db)
+	if err := group.DetachSessions(); err != nil {
+		return fmt.Errorf("purgeGroup: %v", err)
+	}
+	if _, err := db.aliasCollection.DeleteMany(db.ctx, bson.M{"group": _id}); err != nil {
+		return fmt.Errorf("purgeGroup aliases: %v", err)
+	}
+	if _, err := db.ruleCollection.DeleteMany(db.ctx, bson.M{"group": id}); err != nil {
+		return fmt.Errorf("purgeGroup rules: %v", err)
+	}
+	if _, err := db.escalationCollection.DeleteMany(db.ctx, bson.M{"group": id}); err != nil {
+		return fmt.Errorf("purgeGroup escalations: %v", err)
+	}
+	if _, err := db.scheduleCollection.DeleteMany(db.ctx, bson.M{"jobType": "RecurringPushJob", "job.group": id}); err != nil {
+		return fmt.Errorf("purgeGroup entries: %v", err)
+	}
+	if _, err := db.recurringCollection.DeleteMany(db.ctx, bson.M{"group": id}); err != nil {
+		return fmt.Errorf("purgeGroup recurrings: %v", err)
+	}
+	if _, err := db.groupCollection.DeleteOne(db.ctx, bson.M{"_id": _id}); err != nil {
+		return fmt.Errorf("purgeGroup: %v", err)
+	}
+	return nil
+}
+
+// GetDeletedBefore returns the ids of the sessions and groups soft deleted
+// before t.
+func (db *MongoDatabase) GetDeletedBefore(t time.Time) ([]string, []string, error) {
+	filter := bson.M{"deleted": bson.M{"$lt": t}}
+	cur, err := db.sessionCollection.Find(db.ctx, filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getDeletedBefore: %v", err)
+	}
+	var ss []sessionBson
+	if err := cur.All(db.ctx, &ss); err != nil {
+		return nil, nil, fmt.Errorf("getDeletedBefore: %v", err)
+	}
+	cur, err = db.groupCollection.Find(db.ctx, filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getDeletedBefore: %v", err)
+	}
+	var gs []groupBson
+	if err := cur.All(db.ctx, &gs); err != nil {
+		return nil, nil, fmt.Errorf("getDeletedBefore: %v", err)
+	}
+	sessions := Map(ss, func(s sessionBson) string { return s.ID.Hex() })
+	groups := Map(gs, func(g groupBson) string { return g.ID.Hex() })
+	return sessions, groups, nil
+}
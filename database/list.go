@@ -0,0 +1,251 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// ListOptions selects a page of groups or sessions. Sort is a field name,
+// prefixed with - for descending order; Cursor is the next cursor of the
+// previous page. Group selects the sessions in a group or added to it, and
+// Data matches fields of the data to plain values.
+type ListOptions struct {
+	Limit    int
+	Cursor   string
+	Sort     string
+	Hidden   *bool
+	Group    string
+	Parent   string
+	HookHost string
+	Data     map[string]any
+}
+
+// sortFields maps the sortable fields to document keys.
+var sortFields = map[string]string{
+	"id":   "_id",
+	"hook": "hook",
+	"host": "hookHost",
+}
+
+type listCursor struct {
+	Value string `json:"v,omitempty"`
+	ID    string `json:"id"`
+}
+
+// hookHost returns the lower cased host of a hook, or the address of a mailto hook.
+func hookHost(hook string) string {
+	u, err := url.Parse(hook)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "mailto" {
+		if i := strings.LastIndex(u.Opaque, "@"); i >= 0 {
+			return strings.ToLower(u.Opaque[i+1:])
+		}
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func (o ListOptions) limit() int64 {
+	switch {
+	case o.Limit <= 0:
+		return DefaultListLimit
+	case o.Limit > MaxListLimit:
+		return MaxListLimit
+	}
+	return int64(o.Limit)
+}
+
+// page adds the sort order and the cursor position to filter and returns the
+// find options. Ties are broken by _id so every document is listed once.
+func (o ListOptions) page(filter bson.M) (*options.FindOptions, string, error) {
+	field, dir := strings.TrimPrefix(o.Sort, "-"), 1
+	if strings.HasPrefix(o.Sort, "-") {
+		dir = -1
+	}
+	if field == "" {
+		field = "id"
+	}
+	key, ok := sortFields[field]
+	if !ok {
+		return nil, "", fmt.Errorf("cannot sort by %q", field)
+	}
+	cmp := "$gt"
+	if dir < 0 {
+		cmp = "$lt"
+	}
+	if o.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+		var c listCursor
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		id, err2 := primitive.ObjectIDFromHex(c.ID)
+		if err != nil || err2 != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", o.Cursor)
+		}
+		if key == "_id" {
+			filter["_id"] = bson.M{cmp: id}
+		} else {
+			filter["$or"] = bson.A{
+				bson.M{key: bson.M{cmp: c.Value}},
+				bson.M{key: c.Value, "_id": bson.M{cmp: id}},
+			}
+		}
+	}
+	sort := bson.D{{Key: "_id", Value: dir}}
+	if key != "_id" {
+		sort = bson.D{{Key: key, Value: dir}, {Key: "_id", Value: dir}}
+	}
+	return options.Find().SetSort(sort).SetLimit(o.limit() + 1), key, nil
+}
+
+func nextCursor(key string, value string, id primitive.ObjectID) string {
+	c := listCursor{ID: id.Hex()}
+	if key != "_id" {
+		c.Value = value
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// dataFilter matches each data field to a plain value. Operators are not
+// accepted, neither as keys nor inside objects or arrays.
+func dataFilter(filter bson.M, data map[string]any) error {
+	for k, v := range data {
+		for _, f := range strings.Split(k, ".") {
+			if f == "" || strings.HasPrefix(f, "$") {
+				return fmt.Errorf("invalid data field %q", k)
+			}
+		}
+		switch v.(type) {
+		case map[string]any, []any:
+			return fmt.Errorf("data field %q is not a plain value", k)
+		}
+		filter["data.Value."+k] = bson.M{"$eq": v}
+	}
+	return nil
+}
+
+// findPage returns the page, whether more documents follow and the sort key.
+func findPage[T any](db *MongoDatabase, c *mongo.Collection, filter bson.M, o ListOptions) ([]T, bool, string, error) {
+	opts, key, err := o.page(filter)
+	if err != nil {
+		return nil, false, "", err
+	}
+	cur, err := c.Find(db.ctx, filter, opts)
+	if err != nil {
+		return nil, false, "", err
+	}
+	var l []T
+	if err := cur.All(db.ctx, &l); err != nil {
+		return nil, false, "", err
+	}
+	more := int64(len(l)) > o.limit()
+	if more {
+		l = l[:o.limit()]
+	}
+	return l, more, key, nil
+}
+
+// ListSessions returns a page of sessions and the cursor of the next page,
+// empty on the last page.
+func (db *MongoDatabase) ListSessions(o ListOptions) ([]Session, string, error) {
+	filter := bson.M{"deleted": notDeleted}
+	if o.Hidden != nil {
+		if *o.Hidden {
+			filter["hide"] = true
+		} else {
+			filter["hide"] = bson.M{"$ne": true}
+		}
+	}
+	if o.Group != "" {
+		g, err := primitive.ObjectIDFromHex(o.Group)
+		if err != nil {
+			return nil, "", fmt.Errorf("listSessions invalid group \"%v\": %v", o.Group, err)
+		}
+		// the cursor may use $or, so membership goes under $and
+		filter["$and"] = bson.A{bson.M{"$or": bson.A{bson.M{"group": g}, bson.M{"groups": g}}}}
+	}
+	if o.HookHost != "" {
+		filter["hookHost"] = strings.ToLower(o.HookHost)
+	}
+	if err := dataFilter(filter, o.Data); err != nil {
+		return nil, "", fmt.Errorf("listSessions: %v", err)
+	}
+	l, more, key, err := findPage[sessionBson](db, db.sessionCollection, filter, o)
+	if err != nil {
+		return nil, "", fmt.Errorf("listSessions: %v", err)
+	}
+	next := ""
+	if more {
+		last := l[len(l)-1]
+		value := last.Hook
+		if key == "hookHost" {
+			value = last.HookHost
+		}
+		next = nextCursor(key, value, last.ID)
+	}
+	f := func(s sessionBson) Session { r := s.toSession(db); return &r }
+	return Map(l, f), next, nil
+}
+
+// ListGroups returns a page of groups and the cursor of the next page. Only
+// sorting by id is supported.
+func (db *MongoDatabase) ListGroups(o ListOptions) ([]Group, string, error) {
+	filter := bson.M{"deleted": notDeleted}
+	if o.Parent != "" {
+		p, err := primitive.ObjectIDFromHex(o.Parent)
+		if err != nil {
+			return nil, "", fmt.Errorf("listGroups invalid parent \"%v\": %v", o.Parent, err)
+		}
+		filter["parent"] = p
+	}
+	if err := dataFilter(filter, o.Data); err != nil {
+		return nil, "", fmt.Errorf("listGroups: %v", err)
+	}
+	if f := strings.TrimPrefix(o.Sort, "-"); f != "" && f != "id" {
+		return nil, "", fmt.Errorf("listGroups: cannot sort by %q", f)
+	}
+	l, more, _, err := findPage[groupBson](db, db.groupCollection, filter, o)
+	if err != nil {
+		return nil, "", fmt.Errorf("listGroups: %v", err)
+	}
+	next := ""
+	if more {
+		next = nextCursor("_id", "", l[len(l)-1].ID)
+	}
+	f := func(g groupBson) Group { r := g.toGroup(db); return &r }
+	return Map(l, f), next, nil
+}
+
+// backfillHookHosts sets hookHost on sessions created before it was stored.
+func (db *MongoDatabase) backfillHookHosts() error {
+	cur, err := db.sessionCollection.Find(db.ctx, bson.M{"hookHost": bson.M{"$exists": false}, "hook": bson.M{"$ne": ""}})
+	if err != nil {
+		return err
+	}
+	var l []sessionBson
+	if err := cur.All(db.ctx, &l); err != nil {
+		return err
+	}
+	for _, s := range l {
+		if err := setSomethingById(db.ctx, db.sessionCollection, s.ID, "hookHost", hookHost(s.Hook)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -12,13 +12,19 @@ import (
 )
 
 type MongoDatabase struct {
-	tbcPushDatabase    *mongo.Database
-	groupCollection    *mongo.Collection
-	sessionCollection  *mongo.Collection
-	stateCollection    *mongo.Collection
-	scheduleCollection *mongo.Collection
-	ctx                context.Context
-	client             *mongo.Client
+	tbcPushDatabase      *mongo.Database
+	groupCollection      *mongo.Collection
+	sessionCollection    *mongo.Collection
+	stateCollection      *mongo.Collection
+	scheduleCollection   *mongo.Collection
+	deliveryCollection   *mongo.Collection
+	aliasCollection      *mongo.Collection
+	ruleCollection       *mongo.Collection
+	auditCollection      *mongo.Collection
+	escalationCollection *mongo.Collection
+	recurringCollection  *mongo.Collection
+	ctx                  context.Context
+	client               *mongo.Client
 }
 
 func NewMongo(atlasURI string, database string) (Database, error) {
@@ -38,15 +44,48 @@ func NewMongo(atlasURI string, database string) (Database, error) {
 	}
 	d := client.Database(database)
 	gr := d.Collection("group")
+	if _, err := gr.Indexes().CreateMany(ctx, groupIndexes()); err != nil {
+		return nil, err
+	}
 	se := d.Collection("session")
+	if _, err := se.Indexes().CreateMany(ctx, sessionIndexes()); err != nil {
+		return nil, err
+	}
 	sc := d.Collection("schedule")
+	de := d.Collection("delivery")
+	al := d.Collection("alias")
+	ru := d.Collection("rule")
+	au := d.Collection("audit")
+	if _, err := au.Indexes().CreateOne(ctx, auditIndex()); err != nil {
+		return nil, err
+	}
+	if _, err := al.Indexes().CreateOne(ctx, aliasIndex()); err != nil {
+		return nil, err
+	}
+	es := d.Collection("escalation")
+	if _, err := es.Indexes().CreateOne(ctx, escalationIndex()); err != nil {
+		return nil, err
+	}
+	rc := d.Collection("recurring")
+	if _, err := rc.Indexes().CreateMany(ctx, recurringIndexes()); err != nil {
+		return nil, err
+	}
 	db := MongoDatabase{
-		ctx:                ctx,
-		tbcPushDatabase:    d,
-		groupCollection:    gr,
-		sessionCollection:  se,
-		scheduleCollection: sc,
-		client:             client,
+		ctx:                  ctx,
+		tbcPushDatabase:      d,
+		groupCollection:      gr,
+		sessionCollection:    se,
+		scheduleCollection:   sc,
+		deliveryCollection:   de,
+		aliasCollection:      al,
+		ruleCollection:       ru,
+		auditCollection:      au,
+		escalationCollection: es,
+		recurringCollection:  rc,
+		client:               client,
+	}
+	if err := db.backfillHookHosts(); err != nil {
+		return nil, err
 	}
 	return &db, nil
 }
@@ -70,7 +109,7 @@ func (db *MongoDatabase) GetGroupByID(id string) (Group, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getGroupByID invalid id \"%v\": %v", id, err)
 	}
-	r := db.groupCollection.FindOne(db.ctx, bson.D{{"_id", _id}})
+	r := db.groupCollection.FindOne(db.ctx, bson.M{"_id": _id, "deleted": notDeleted})
 	g := groupBson{}
 	if err := r.Decode(&g); err != nil {
 		return nil, fmt.Errorf("getGroupByID: %v", err)
@@ -84,7 +123,7 @@ func (db *MongoDatabase) GetSessionByID(id string) (Session, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getSessionByID invalid id \"%v\": %v", id, err)
 	}
-	r := db.sessionCollection.FindOne(db.ctx, bson.D{{"_id", _id}})
+	r := db.sessionCollection.FindOne(db.ctx, bson.M{"_id": _id, "deleted": notDeleted})
 	g := sessionBson{}
 	if err := r.Decode(&g); err != nil {
 		return nil, fmt.Errorf("getSessionByID: %v", err)
@@ -94,7 +133,7 @@ func (db *MongoDatabase) GetSessionByID(id string) (Session, error) {
 }
 
 func (db *MongoDatabase) GetAllGroups() ([]Group, error) {
-	cur, err := db.groupCollection.Find(db.ctx, bson.M{})
+	cur, err := db.groupCollection.Find(db.ctx, bson.M{"deleted": notDeleted})
 	if err != nil {
 		return nil, fmt.Errorf("getAllGroup Find: %v", err)
 	}
@@ -107,7 +146,7 @@ func (db *MongoDatabase) GetAllGroups() ([]Group, error) {
 }
 
 func (db *MongoDatabase) NewSession(hook string, data any) (string, error) {
-	s := sessionBson{Hook: hook, Data: bson.M{"Value": data}}
+	s := sessionBson{Hook: hook, HookHost: hookHost(hook), Data: bson.M{"Value": data}}
 	r, err := db.sessionCollection.InsertOne(db.ctx, s)
 	if err != nil {
 		return "", fmt.Errorf("newSession: %v", err)
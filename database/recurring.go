@@ -0,0 +1,139 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type recurringBson struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Recurring `bson:",inline"`
+}
+
+func (r recurringBson) toRecurring() Recurring {
+	ret := r.Recurring
+	ret.ID = r.ID.Hex()
+	return ret
+}
+
+func recurringIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "session", Value: 1}, {Key: "created", Value: -1}}},
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "created", Value: -1}}},
+	}
+}
+
+func (db *MongoDatabase) NewRecurring(r Recurring) (string, error) {
+	res, err := db.recurringCollection.InsertOne(db.ctx, recurringBson{Recurring: r})
+	if err != nil {
+		return "", fmt.Errorf("newRecurring: %v", err)
+	}
+	id := (res.InsertedID).(primitive.ObjectID)
+	return id.Hex(), nil
+}
+
+func (db *MongoDatabase) GetRecurringByID(id string) (Recurring, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Recurring{}, fmt.Errorf("getRecurringByID invalid id \"%v\": %v", id, err)
+	}
+	r := recurringBson{}
+	if err := db.recurringCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&r); err != nil {
+		return Recurring{}, fmt.Errorf("getRecurringByID: %v", err)
+	}
+	return r.toRecurring(), nil
+}
+
+// GetRecurrings returns the latest recurring pushes, newest first. Non-empty
+// session, group and status select only those matching.
+func (db *MongoDatabase) GetRecurrings(session string, group string, status string, limit int) ([]Recurring, error) {
+	filter := bson.M{}
+	if session != "" {
+		filter["session"] = session
+	}
+	if group != "" {
+		filter["group"] = group
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.M{"created": -1}).SetLimit(int64(limit))
+	cur, err := db.recurringCollection.Find(db.ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("getRecurrings: %v", err)
+	}
+	var rs []recurringBson
+	if err := cur.All(db.ctx, &rs); err != nil {
+		return nil, fmt.Errorf("getRecurrings: %v", err)
+	}
+	return Map(rs, recurringBson.toRecurring), nil
+}
+
+// SetRecurringState saves the status, Until, Entry and Updated of r if its
+// status is still from, and tells if it was.
+func (db *MongoDatabase) SetRecurringState(r Recurring, from string) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(r.ID)
+	if err != nil {
+		return false, fmt.Errorf("setRecurringState invalid id \"%v\": %v", r.ID, err)
+	}
+	set := bson.M{"status": r.Status, "updated": r.Updated}
+	unset := bson.M{}
+	if r.Until.IsZero() {
+		unset["until"] = ""
+	} else {
+		set["until"] = r.Until
+	}
+	if r.Entry == "" {
+		unset["entry"] = ""
+	} else {
+		set["entry"] = r.Entry
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	res, err := db.recurringCollection.UpdateOne(db.ctx, bson.M{"_id": _id, "status": from}, update)
+	if err != nil {
+		return false, fmt.Errorf("setRecurringState: %v", err)
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// RecordRecurringRun counts a run of an active recurring push made at t,
+// finishing it if finished, and tells if it was still active.
+func (db *MongoDatabase) RecordRecurringRun(id string, t time.Time, finished bool) (bool, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, fmt.Errorf("recordRecurringRun invalid id \"%v\": %v", id, err)
+	}
+	update := bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"last": t, "updated": t}}
+	if finished {
+		update["$set"].(bson.M)["status"] = RecurringFinished
+		update["$unset"] = bson.M{"entry": ""}
+	}
+	res, err := db.recurringCollection.UpdateOne(db.ctx, bson.M{"_id": _id, "status": RecurringActive}, update)
+	if err != nil {
+		return false, fmt.Errorf("recordRecurringRun: %v", err)
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (db *MongoDatabase) DeleteRecurring(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("deleteRecurring invalid id \"%v\": %v", id, err)
+	}
+	res, err := db.recurringCollection.DeleteOne(db.ctx, bson.M{"_id": _id})
+	if err != nil {
+		return fmt.Errorf("deleteRecurring: %v", err)
+	}
+	if res.DeletedCount != 1 {
+		return fmt.Errorf("deleteRecurring: deleted count is %v", res.DeletedCount)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ruleBson struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Rule `bson:",inline"`
+}
+
+func (r ruleBson) toRule() Rule {
+	rule := r.Rule
+	rule.ID = r.ID.Hex()
+	return rule
+}
+
+func (db *MongoDatabase) NewRule(rule Rule) (string, error) {
+	r, err := db.ruleCollection.InsertOne(db.ctx, ruleBson{Rule: rule})
+	if err != nil {
+		return "", fmt.Errorf("newRule: %v", err)
+	}
+	id := (r.InsertedID).(primitive.ObjectID)
+	return id.Hex(), nil
+}
+
+func (db *MongoDatabase) GetRuleByID(id string) (Rule, error) {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Rule{}, fmt.Errorf("getRuleByID invalid id \"%v\": %v", id, err)
+	}
+	r := ruleBson{}
+	if err := db.ruleCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&r); err != nil {
+		return Rule{}, fmt.Errorf("getRuleByID: %v", err)
+	}
+	return r.toRule(), nil
+}
+
+func (db *MongoDatabase) GetAllRules() ([]Rule, error) {
+	cur, err := db.ruleCollection.Find(db.ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("getAllRules: %v", err)
+	}
+	var rs []ruleBson
+	if err := cur.All(db.ctx, &rs); err != nil {
+		return nil, fmt.Errorf("getAllRules: %v", err)
+	}
+	rules := []Rule{}
+	for _, r := range rs {
+		rules = append(rules, r.toRule())
+	}
+	return rules, nil
+}
+
+func (db *MongoDatabase) UpdateRule(rule Rule) error {
+	_id, err := primitive.ObjectIDFromHex(rule.ID)
+	if err != nil {
+		return fmt.Errorf("updateRule invalid id \"%v\": %v", rule.ID, err)
+	}
+	r, err := db.ruleCollection.ReplaceOne(db.ctx, bson.M{"_id": _id}, ruleBson{Rule: rule})
+	if err != nil {
+		return fmt.Errorf("updateRule: %v", err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("updateRule: %v", mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+func (db *MongoDatabase) DeleteRule(id string) error {
+	_id, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("deleteRule invalid id \"%v\": %v", id, err)
+	}
+	r, err := db.ruleCollection.DeleteOne(db.ctx, bson.M{"_id": _id})
+	if err != nil {
+		return fmt.Errorf("deleteRule: %v", err)
+	}
+	if r.DeletedCount == 0 {
+		return fmt.Errorf("deleteRule: %v", mongo.ErrNoDocuments)
+	}
+	return nil
+}
@@ -68,8 +68,15 @@ type scheduleWrapper struct {
 	e *entry
 }
 
-func (w scheduleWrapper) Next(time.Time) time.Time {
-	r := w.s.Next(w.e.next)
+// Next computes the following run from the previous one so recurring schedules
+// do not drift. Runs missed while the program was down are skipped.
+func (w scheduleWrapper) Next(t time.Time) time.Time {
+	var r time.Time
+	if w.e.next.IsZero() {
+		r = w.s.Next(t)
+	} else if r = w.s.Next(w.e.next); !r.IsZero() && !r.After(t) {
+		r = w.s.Next(t)
+	}
 	w.e.Save()
 	return r
 }
@@ -97,6 +104,13 @@ func (w jobWrapper) Run() {
 	w.e.Save()
 }
 
+func (w jobWrapper) Priority() int {
+	if p, ok := w.j.(scheduler.Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
 func (e *entry) Job() scheduler.Job {
 	return jobWrapper{e.job, e}
 }
@@ -133,23 +147,28 @@ func (e *entry) GetID() string {
 	return e.id.Hex()
 }
 
+// Save writes the entry back. Entries removed in the meantime, such as one-time
+// entries whose job is still running, stay removed.
 func (e *entry) Save() error {
 	b, err := e.toBson()
 	if err != nil {
 		return err
 	}
-	if e.id.IsZero() {
-		r, err := e.db.scheduleCollection.InsertOne(e.db.ctx, b)
-		if err != nil {
-			return err
-		}
-		e.id = r.InsertedID.(primitive.ObjectID)
-	} else {
-		_, err := e.db.scheduleCollection.UpdateOne(e.db.ctx, bson.M{"_id": e.id}, bson.M{"$set": b})
-		if err != nil {
-			return err
-		}
+	_, err = e.db.scheduleCollection.UpdateOne(e.db.ctx, bson.M{"_id": e.id}, bson.M{"$set": b})
+	return err
+}
+
+// insert stores a new entry.
+func (e *entry) insert() error {
+	b, err := e.toBson()
+	if err != nil {
+		return err
+	}
+	r, err := e.db.scheduleCollection.InsertOne(e.db.ctx, b)
+	if err != nil {
+		return err
 	}
+	e.id = r.InsertedID.(primitive.ObjectID)
 	return nil
 }
 
@@ -191,7 +210,7 @@ func (db *MongoDatabase) GetEntryByID(id string, scheduleGetter SaveableGetter[S
 	if err != nil {
 		return nil, fmt.Errorf("invalid id: %v", err)
 	}
-	if err := db.groupCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&b); err != nil {
+	if err := db.scheduleCollection.FindOne(db.ctx, bson.M{"_id": _id}).Decode(&b); err != nil {
 		return nil, err
 	}
 	e, err := b.toEntry(scheduleGetter, jobGetter)
@@ -216,8 +235,11 @@ func NewEntryList(db Database, scheduleGetter SaveableGetter[Schedule], jobGette
 	}
 }
 
+// NewEntry creates an entry with its id already assigned, so callers can
+// keep a reference to it before the scheduler saves it.
 func (l *EntryList) NewEntry(job scheduler.Job, schedule scheduler.Schedule) scheduler.Entry {
 	return &entry{
+		id:       primitive.NewObjectID(),
 		db:       l.db.(*MongoDatabase),
 		job:      job.(Job),
 		schedule: schedule.(Schedule),
@@ -241,7 +263,7 @@ func (l *EntryList) All() []scheduler.Entry {
 }
 
 func (l *EntryList) Add(e scheduler.Entry) {
-	if err := e.(Entry).Save(); err != nil {
+	if err := e.(*entry).insert(); err != nil {
 		fmt.Printf("error saving entry: %v\n", err)
 	}
 }
@@ -2,9 +2,11 @@ package database
 
 import (
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type session struct {
@@ -12,19 +14,48 @@ type session struct {
 	Group    primitive.ObjectID
 	Data     any
 	PushHook string
+	Timezone string
+	Quiet    QuietHours
+	Digest   Digest
+	Format   Format
+	Channel  string
+	Topics   []string
+	Tags     []string
+	Groups   []primitive.ObjectID
+	Hidden   bool
+	Deleted  time.Time
+	Verify   Verification
+	Client   ClientOptions
+	Health   Health
 	db       *MongoDatabase
 }
 
 type sessionBson struct {
-	ID    primitive.ObjectID `bson:"_id,omitempty"`
-	Group primitive.ObjectID `bson:"group,omitempty"`
-	Data  bson.M             `bson:"data,omitempty"`
-	Hook  string             `bson:"hook,omitempty"`
-	Hide  bool               `bson:"hide,omitempty"`
+	ID       primitive.ObjectID   `bson:"_id,omitempty"`
+	Group    primitive.ObjectID   `bson:"group,omitempty"`
+	Data     bson.M               `bson:"data,omitempty"`
+	Hook     string               `bson:"hook,omitempty"`
+	HookHost string               `bson:"hookHost,omitempty"`
+	Hide     bool                 `bson:"hide,omitempty"`
+	TZ       string               `bson:"timezone,omitempty"`
+	Quiet    QuietHours           `bson:"quiet,omitempty"`
+	Digest   Digest               `bson:"digest,omitempty"`
+	Format   Format               `bson:"format,omitempty"`
+	Channel  string               `bson:"channel,omitempty"`
+	Topics   []string             `bson:"topics,omitempty"`
+	Tags     []string             `bson:"tags,omitempty"`
+	Groups   []primitive.ObjectID `bson:"groups,omitempty"`
+	Deleted  time.Time            `bson:"deleted,omitempty"`
+	Verify   Verification         `bson:"verification,omitempty"`
+	Client   ClientOptions        `bson:"client,omitempty"`
+	Health   Health               `bson:"health,omitempty"`
 }
 
 func (s sessionBson) toSession(db *MongoDatabase) session {
-	return session{ID: s.ID, Group: s.Group, Data: s.Data["Value"], db: db, PushHook: s.Hook}
+	return session{ID: s.ID, Group: s.Group, Data: s.Data["Value"], db: db, PushHook: s.Hook, Timezone: s.TZ, Quiet: s.Quiet,
+		Digest: s.Digest, Format: s.Format, Channel: s.Channel, Topics: s.Topics, Tags: s.Tags, Groups: s.Groups,
+		Hidden: s.Hide, Deleted: s.Deleted, Verify: s.Verify, Client: s.Client,
+		Health: s.Health}
 }
 func (s *session) GetID() string {
 	return s.ID.Hex()
@@ -45,14 +76,20 @@ func (s *session) GetGroupID() string {
 	return s.Group.Hex()
 }
 
+// SetGroupID moves the session to a group. It leaves its former group
+// entirely, and a membership in the new one becomes its group.
 func (s *session) SetGroupID(groupID string) error {
 	id, err := primitive.ObjectIDFromHex(groupID)
 	if err != nil {
 		return fmt.Errorf("session setGroup invalid id: %v", err)
 	}
-	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "group", id); err != nil {
+	from := s.Group
+	update := bson.M{"$set": bson.M{"group": id}, "$pull": bson.M{"groups": bson.M{"$in": bson.A{id, from}}}}
+	if _, err := s.db.sessionCollection.UpdateByID(s.db.ctx, s.ID, update); err != nil {
 		return fmt.Errorf("session setGroup: %v", err)
 	}
+	s.Group = id
+	s.Groups = Filter(s.Groups, func(g primitive.ObjectID) bool { return g != id && g != from })
 	return nil
 }
 
@@ -68,6 +105,10 @@ func (s *session) SetPushHook(url string) error {
 	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "hook", url); err != nil {
 		return fmt.Errorf("session setPushHook: %v", err)
 	}
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "hookHost", hookHost(url)); err != nil {
+		return fmt.Errorf("session setPushHook: %v", err)
+	}
+	s.PushHook = url
 	return nil
 }
 
@@ -75,5 +116,198 @@ func (s *session) Hide() error {
 	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "hide", true); err != nil {
 		return fmt.Errorf("session hide: %v", err)
 	}
+	s.Hidden = true
+	return nil
+}
+
+func (s *session) GetTimezone() string {
+	return s.Timezone
+}
+
+func (s *session) SetTimezone(tz string) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "timezone", tz); err != nil {
+		return fmt.Errorf("session setTimezone: %v", err)
+	}
+	s.Timezone = tz
+	return nil
+}
+
+func (s *session) GetQuietHours() QuietHours {
+	return s.Quiet
+}
+
+func (s *session) SetQuietHours(q QuietHours) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "quiet", q); err != nil {
+		return fmt.Errorf("session setQuietHours: %v", err)
+	}
+	s.Quiet = q
+	return nil
+}
+
+func (s *session) GetDigest() Digest {
+	return s.Digest
+}
+
+func (s *session) SetDigest(d Digest) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "digest", d); err != nil {
+		return fmt.Errorf("session setDigest: %v", err)
+	}
+	s.Digest = d
+	return nil
+}
+
+func (s *session) GetFormat() Format {
+	return s.Format
+}
+
+func (s *session) SetFormat(f Format) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "format", f); err != nil {
+		return fmt.Errorf("session setFormat: %v", err)
+	}
+	s.Format = f
+	return nil
+}
+
+func (s *session) GetChannel() string {
+	return s.Channel
+}
+
+func (s *session) SetChannel(channel string) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "channel", channel); err != nil {
+		return fmt.Errorf("session setChannel: %v", err)
+	}
+	s.Channel = channel
+	return nil
+}
+
+func (s *session) GetTopics() []string {
+	return s.Topics
+}
+
+func (s *session) SetTopics(topics []string) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "topics", topics); err != nil {
+		return fmt.Errorf("session setTopics: %v", err)
+	}
+	s.Topics = topics
+	return nil
+}
+
+func (s *session) GetTags() []string {
+	return s.Tags
+}
+
+func (s *session) SetTags(tags []string) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "tags", tags); err != nil {
+		return fmt.Errorf("session setTags: %v", err)
+	}
+	s.Tags = tags
+	return nil
+}
+
+// GetGroupIDs returns the session group followed by the other groups it joined.
+func (s *session) GetGroupIDs() []string {
+	r := []string{}
+	if !s.Group.IsZero() {
+		r = append(r, s.Group.Hex())
+	}
+	for _, g := range s.Groups {
+		if g != s.Group {
+			r = append(r, g.Hex())
+		}
+	}
+	return r
+}
+
+// AddGroup makes the session a member of another group. A session without a
+// group gets it as its group.
+func (s *session) AddGroup(groupID string) error {
+	id, err := primitive.ObjectIDFromHex(groupID)
+	if err != nil {
+		return fmt.Errorf("session addGroup invalid id: %v", err)
+	}
+	if s.Group.IsZero() {
+		if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "group", id); err != nil {
+			return fmt.Errorf("session addGroup: %v", err)
+		}
+		s.Group = id
+		return nil
+	}
+	if id == s.Group {
+		return nil
+	}
+	if _, err := s.db.sessionCollection.UpdateByID(s.db.ctx, s.ID, bson.M{"$addToSet": bson.M{"groups": id}}); err != nil {
+		return fmt.Errorf("session addGroup: %v", err)
+	}
+	s.Groups = append(Filter(s.Groups, func(g primitive.ObjectID) bool { return g != id }), id)
 	return nil
 }
+
+// RemoveGroup leaves a group. Leaving the session group unsets it.
+func (s *session) RemoveGroup(groupID string) error {
+	id, err := primitive.ObjectIDFromHex(groupID)
+	if err != nil {
+		return fmt.Errorf("session removeGroup invalid id: %v", err)
+	}
+	update := bson.M{"$pull": bson.M{"groups": id}}
+	if id == s.Group {
+		update["$unset"] = bson.M{"group": ""}
+	}
+	if _, err := s.db.sessionCollection.UpdateByID(s.db.ctx, s.ID, update); err != nil {
+		return fmt.Errorf("session removeGroup: %v", err)
+	}
+	if id == s.Group {
+		s.Group = primitive.NilObjectID
+	}
+	s.Groups = Filter(s.Groups, func(g primitive.ObjectID) bool { return g != id })
+	return nil
+}
+
+func (s *session) GetVerification() Verification {
+	return s.Verify
+}
+
+func (s *session) SetVerification(v Verification) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "verification", v); err != nil {
+		return fmt.Errorf("session setVerification: %v", err)
+	}
+	s.Verify = v
+	return nil
+}
+
+func (s *session) GetClientOptions() ClientOptions {
+	return s.Client
+}
+
+func (s *session) SetClientOptions(o ClientOptions) error {
+	if err := setSomethingById(s.db.ctx, s.db.sessionCollection, s.ID, "client", o); err != nil {
+		return fmt.Errorf("session setClientOptions: %v", err)
+	}
+	s.Client = o
+	return nil
+}
+
+type digestQueueBson struct {
+	Queue []string `bson:"digestQueue"`
+}
+
+// AppendDigest queues an item for the next digest and returns the queue length.
+func (s *session) AppendDigest(item string) (int, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"digestQueue": 1})
+	r := s.db.sessionCollection.FindOneAndUpdate(s.db.ctx, bson.M{"_id": s.ID}, bson.M{"$push": bson.M{"digestQueue": item}}, opts)
+	var q digestQueueBson
+	if err := r.Decode(&q); err != nil {
+		return 0, fmt.Errorf("session appendDigest: %v", err)
+	}
+	return len(q.Queue), nil
+}
+
+// TakeDigest empties the digest queue and returns what it held.
+func (s *session) TakeDigest() ([]string, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before).SetProjection(bson.M{"digestQueue": 1})
+	r := s.db.sessionCollection.FindOneAndUpdate(s.db.ctx, bson.M{"_id": s.ID}, bson.M{"$set": bson.M{"digestQueue": []string{}}}, opts)
+	var q digestQueueBson
+	if err := r.Decode(&q); err != nil {
+		return nil, fmt.Errorf("session takeDigest: %v", err)
+	}
+	return q.Queue, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tagQuery builds the session filter for a tag expression.
+func tagQuery(e TagExpr) (bson.M, error) {
+	switch e.Op {
+	case TagEq:
+		return bson.M{"tags": e.Key + "=" + e.Value}, nil
+	case TagHas:
+		return bson.M{"tags": bson.M{"$regex": "^" + regexp.QuoteMeta(e.Key) + "(=|$)"}}, nil
+	case TagNot:
+		if len(e.Args) != 1 {
+			return nil, fmt.Errorf("tag expression: not takes one argument")
+		}
+		q, err := tagQuery(e.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{q}}, nil
+	case TagAnd, TagOr:
+		l := bson.A{}
+		for _, a := range e.Args {
+			q, err := tagQuery(a)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, q)
+		}
+		return bson.M{"$" + e.Op: l}, nil
+	}
+	return nil, fmt.Errorf("tag expression: unknown op %q", e.Op)
+}
+
+// sessionIndexes serve the group, topic and tag lookups of FindSessions and
+// the filters and sort orders of ListSessions.
+func sessionIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "topics", Value: 1}}},
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "groups", Value: 1}}},
+		{Keys: bson.D{{Key: "group", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "hookHost", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "hook", Value: 1}, {Key: "_id", Value: 1}}},
+	}
+}
+
+func groupIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{{Keys: bson.D{{Key: "parent", Value: 1}, {Key: "_id", Value: 1}}}}
+}
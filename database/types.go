@@ -1,6 +1,10 @@
 package database
 
-import "github.com/turbitcat/tbcpusher/v2/scheduler"
+import (
+	"time"
+
+	"github.com/turbitcat/tbcpusher/v2/scheduler"
+)
 
 type Group interface {
 	GetID() string
@@ -8,6 +12,20 @@ type Group interface {
 	SetData(data any) error
 	NewSession(hook string, data any) (string, error)
 	GetSessions() ([]Session, error)
+	GetOwnSessions() ([]Session, error)
+	FindSessions(topic string, tags *TagExpr) ([]Session, error)
+	GetParentID() string
+	SetParentID(parent string) error
+	GetChildren() ([]Group, error)
+	GetDescendants() ([]Group, error)
+	GetDeletedAt() time.Time
+	SoftDelete(t time.Time, deleteSessions bool) error
+	DetachSessions() error
+	GetTemplates() map[string]Template
+	SetTemplate(name string, t Template) error
+	DeleteTemplate(name string) error
+	GetEscalationPolicy() EscalationPolicy
+	SetEscalationPolicy(p EscalationPolicy) error
 }
 
 type Session interface {
@@ -20,6 +38,196 @@ type Session interface {
 	GetPushHook() string
 	SetPushHook(url string) error
 	Hide() error
+	GetTimezone() string
+	SetTimezone(tz string) error
+	GetQuietHours() QuietHours
+	SetQuietHours(q QuietHours) error
+	NewDelivery(message any, status string) (string, error)
+	GetDigest() Digest
+	SetDigest(d Digest) error
+	AppendDigest(item string) (int, error)
+	TakeDigest() ([]string, error)
+	GetFormat() Format
+	SetFormat(f Format) error
+	GetChannel() string
+	SetChannel(channel string) error
+	GetTopics() []string
+	SetTopics(topics []string) error
+	GetTags() []string
+	SetTags(tags []string) error
+	GetGroupIDs() []string
+	AddGroup(groupID string) error
+	RemoveGroup(groupID string) error
+	IsHidden() bool
+	GetVerification() Verification
+	SetVerification(v Verification) error
+	GetClientOptions() ClientOptions
+	SetClientOptions(o ClientOptions) error
+	GetHealth() Health
+	SetHealth(h Health) error
+	RecordSuccess(t time.Time) error
+	RecordFailure(t time.Time, detail string) (Health, error)
+	Unhide() error
+	GetDeletedAt() time.Time
+	SoftDelete(t time.Time) error
+}
+
+// Delivery records the fate of one message pushed to one session.
+type Delivery interface {
+	GetID() string
+	GetSessionID() string
+	GetMessage() any
+	GetStatus() string
+	GetDetail() string
+	GetCreated() time.Time
+	GetUpdated() time.Time
+	GetAckedAt() time.Time
+	GetReadAt() time.Time
+	Ack(t time.Time, readOnly bool) error
+	SetStatus(status string, detail string) error
+}
+
+// TagExpr is a parsed tag expression selecting sessions by their tags, which
+// are stored as "key=value" strings.
+type TagExpr struct {
+	Op    string // TagEq, TagHas, TagNot, TagAnd or TagOr
+	Key   string
+	Value string
+	Args  []TagExpr
+}
+
+const (
+	TagEq  = "eq"
+	TagHas = "has"
+	TagNot = "not"
+	TagAnd = "and"
+	TagOr  = "or"
+)
+
+// Rule turns JSON posted to an inbound hook into a message for a group. The
+// message fields hold JSON path expressions or literal text.
+type Rule struct {
+	ID        string        `bson:"-" json:"id"`
+	Name      string        `bson:"name,omitempty" json:"name,omitempty"`
+	Group     string        `bson:"group" json:"group"`
+	Author    string        `bson:"author,omitempty" json:"author,omitempty"`
+	Title     string        `bson:"title,omitempty" json:"title,omitempty"`
+	Content   string        `bson:"content,omitempty" json:"content,omitempty"`
+	Priority  string        `bson:"priority,omitempty" json:"priority,omitempty"`
+	Signature RuleSignature `bson:"signature,omitempty" json:"signature,omitempty"`
+}
+
+// RuleSignature describes how an inbound hook proves the request is genuine.
+type RuleSignature struct {
+	Type     string `bson:"type,omitempty" json:"type,omitempty"`
+	Header   string `bson:"header,omitempty" json:"header,omitempty"`
+	Prefix   string `bson:"prefix,omitempty" json:"prefix,omitempty"`
+	Encoding string `bson:"encoding,omitempty" json:"encoding,omitempty"`
+	Secret   string `bson:"secret,omitempty" json:"secret,omitempty"`
+}
+
+// Verification tracks the hook ownership handshake of a session. While
+// State is pending the session gets no pushes; a pending Hook replaces the
+// session hook once verified.
+type Verification struct {
+	State   string    `bson:"state,omitempty" json:"state,omitempty"`
+	Token   string    `bson:"token,omitempty" json:"-"`
+	Hook    string    `bson:"hook,omitempty" json:"hook,omitempty"`
+	Expires time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
+}
+
+const (
+	VerificationPending  = "pending"
+	VerificationVerified = "verified"
+)
+
+// EscalationPolicy escalates critical group pushes nobody acknowledged. After
+// Timeout the message goes to the next group of Tiers, or again to the group
+// itself if there are none; the tiers are walked Repeat times, then the
+// fallback group or session is notified.
+type EscalationPolicy struct {
+	Timeout         string   `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	Tiers           []string `bson:"tiers,omitempty" json:"tiers,omitempty"`
+	Repeat          int      `bson:"repeat,omitempty" json:"repeat,omitempty"`
+	FallbackGroup   string   `bson:"fallbackGroup,omitempty" json:"fallbackGroup,omitempty"`
+	FallbackSession string   `bson:"fallbackSession,omitempty" json:"fallbackSession,omitempty"`
+}
+
+const (
+	EscalationActive    = "active"
+	EscalationAcked     = "acked"
+	EscalationExhausted = "exhausted"
+	EscalationCancelled = "cancelled"
+)
+
+// Escalation is the state of one escalating message: the policy it started
+// with, the deliveries whose ack ends it, the next step and when it is due.
+// Entry is the id of the scheduler entry running the next step.
+type Escalation struct {
+	ID         string           `bson:"-" json:"id"`
+	Group      string           `bson:"group" json:"group"`
+	Policy     EscalationPolicy `bson:"policy" json:"policy"`
+	Message    string           `bson:"message" json:"-"`
+	Deliveries []string         `bson:"deliveries" json:"deliveries"`
+	Step       int              `bson:"step" json:"step"`
+	Status     string           `bson:"status" json:"status"`
+	Next       time.Time        `bson:"next,omitempty" json:"next,omitempty"`
+	Entry      string           `bson:"entry,omitempty" json:"-"`
+	Created    time.Time        `bson:"created" json:"created"`
+	Updated    time.Time        `bson:"updated" json:"updated"`
+}
+
+const (
+	RecurringActive   = "active"
+	RecurringPaused   = "paused"
+	RecurringFinished = "finished"
+)
+
+// Recurring is a message pushed to a session or a group every Interval, or at
+// the times of the Cron spec in Timezone, from Start until End and at most Max
+// times if not zero. Until is when the runs left end since it was last started
+// or resumed, and Entry is the id of its scheduler entry while active.
+type Recurring struct {
+	ID       string    `bson:"-" json:"id"`
+	Session  string    `bson:"session,omitempty" json:"session,omitempty"`
+	Group    string    `bson:"group,omitempty" json:"group,omitempty"`
+	Message  string    `bson:"message" json:"-"`
+	Tags     string    `bson:"tags,omitempty" json:"tags,omitempty"`
+	TTL      string    `bson:"ttl,omitempty" json:"ttl,omitempty"`
+	Interval string    `bson:"interval,omitempty" json:"interval,omitempty"`
+	Cron     string    `bson:"cron,omitempty" json:"cron,omitempty"`
+	Timezone string    `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Start    time.Time `bson:"start" json:"start"`
+	End      time.Time `bson:"end,omitempty" json:"end"`
+	Max      int       `bson:"max,omitempty" json:"max,omitempty"`
+	Count    int       `bson:"count" json:"count"`
+	Last     time.Time `bson:"last,omitempty" json:"last"`
+	Status   string    `bson:"status" json:"status"`
+	Until    time.Time `bson:"until,omitempty" json:"-"`
+	Entry    string    `bson:"entry,omitempty" json:"-"`
+	Created  time.Time `bson:"created" json:"created"`
+	Updated  time.Time `bson:"updated" json:"updated"`
+}
+
+// Audit records a change made to a session through the API.
+type Audit struct {
+	Time    time.Time `bson:"time" json:"time"`
+	Session string    `bson:"session" json:"session"`
+	Action  string    `bson:"action" json:"action"`
+	From    string    `bson:"from,omitempty" json:"from,omitempty"`
+	To      string    `bson:"to,omitempty" json:"to,omitempty"`
+	Remote  string    `bson:"remote,omitempty" json:"remote,omitempty"`
+}
+
+// Alias maps a key of a compatibility API, such as a Gotify app token or an
+// ntfy topic, to a group or a session.
+type Alias interface {
+	GetKind() string
+	GetKey() string
+	GetToken() string
+	GetGroupID() string
+	GetSessionID() string
+	GetCreated() time.Time
 }
 
 type Database interface {
@@ -28,6 +236,37 @@ type Database interface {
 	GetGroupByID(id string) (Group, error)
 	GetSessionByID(id string) (Session, error)
 	GetAllGroups() ([]Group, error)
+	ListGroups(o ListOptions) ([]Group, string, error)
+	ListSessions(o ListOptions) ([]Session, string, error)
+	GetDeliveryByID(id string) (Delivery, error)
+	NewAlias(kind string, key string, token string, group string, session string) error
+	GetAlias(kind string, key string) (Alias, error)
+	GetAliases(kind string) ([]Alias, error)
+	DeleteAlias(kind string, key string) error
+	NewRule(rule Rule) (string, error)
+	GetRuleByID(id string) (Rule, error)
+	GetAllRules() ([]Rule, error)
+	UpdateRule(rule Rule) error
+	DeleteRule(id string) error
+	RestoreSession(id string) error
+	RestoreGroup(id string) error
+	PurgeSession(id string) error
+	PurgeGroup(id string) error
+	GetDeletedBefore(t time.Time) (sessions []string, groups []string, err error)
+	GetProbeDue(t time.Time) ([]Session, error)
+	NewEscalation(e Escalation) (string, error)
+	GetEscalationByID(id string) (Escalation, error)
+	GetEscalations(group string, status string, limit int) ([]Escalation, error)
+	UpdateActiveEscalation(e Escalation) (bool, error)
+	AnyAcked(deliveries []string) (bool, error)
+	NewRecurring(r Recurring) (string, error)
+	GetRecurringByID(id string) (Recurring, error)
+	GetRecurrings(session string, group string, status string, limit int) ([]Recurring, error)
+	SetRecurringState(r Recurring, from string) (bool, error)
+	RecordRecurringRun(id string, t time.Time, finished bool) (bool, error)
+	DeleteRecurring(id string) error
+	NewAudit(a Audit) error
+	GetAudit(session string, limit int) ([]Audit, error)
 	GetAllEntries(SaveableGetter[Schedule], SaveableGetter[Job]) ([]Entry, error)
 	GetEntryByID(string, SaveableGetter[Schedule], SaveableGetter[Job]) (Entry, error)
 	Close()
@@ -39,3 +278,72 @@ type Entry interface {
 	Delete() error
 	GetID() string
 }
+
+// QuietWindow is a daily time range in "15:04" format, in the session's time zone.
+// A window whose end is before its start spans midnight.
+type QuietWindow struct {
+	Start string `bson:"start" json:"start"`
+	End   string `bson:"end" json:"end"`
+}
+
+// QuietHours holds the do-not-disturb windows of a session and what to do
+// with messages pushed inside them ("defer" or "drop").
+type QuietHours struct {
+	Windows []QuietWindow `bson:"windows,omitempty" json:"windows"`
+	Action  string        `bson:"action,omitempty" json:"action"`
+}
+
+// Digest batches the messages pushed to a session and delivers them together
+// every Interval or on Cron, or as soon as MaxBatch messages are waiting.
+// Entry is the id of the scheduler entry flushing the batch.
+type Digest struct {
+	Interval string `bson:"interval,omitempty" json:"interval,omitempty"`
+	Cron     string `bson:"cron,omitempty" json:"cron,omitempty"`
+	MaxBatch int    `bson:"maxBatch,omitempty" json:"maxBatch,omitempty"`
+	Entry    string `bson:"entry,omitempty" json:"entry,omitempty"`
+}
+
+// Health tracks the delivery failures of a session. Opened is set while its
+// circuit breaker is open: deliveries then wait or are dropped until a probe
+// at NextProbe succeeds. AutoHidden marks sessions hidden for failing too long.
+type Health struct {
+	Failures    int       `bson:"failures,omitempty" json:"failures"`
+	LastError   string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	LastFailure time.Time `bson:"lastFailure,omitempty" json:"lastFailure,omitempty"`
+	LastSuccess time.Time `bson:"lastSuccess,omitempty" json:"lastSuccess,omitempty"`
+	Opened      time.Time `bson:"opened,omitempty" json:"opened,omitempty"`
+	NextProbe   time.Time `bson:"nextProbe,omitempty" json:"nextProbe,omitempty"`
+	AutoHidden  bool      `bson:"autoHidden,omitempty" json:"autoHidden,omitempty"`
+}
+
+// ClientOptions override the delivery client settings for a session.
+// Timeouts are durations like "10s"; Proxy "direct" bypasses the configured
+// proxy. CA, Cert and Key are PEM blocks, Cert and Key making a client
+// certificate for hooks requiring mutual TLS.
+type ClientOptions struct {
+	ConnectTimeout string `bson:"connectTimeout,omitempty" json:"connectTimeout,omitempty"`
+	Timeout        string `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	Proxy          string `bson:"proxy,omitempty" json:"proxy,omitempty"`
+	CA             string `bson:"ca,omitempty" json:"ca,omitempty"`
+	Cert           string `bson:"cert,omitempty" json:"cert,omitempty"`
+	Key            string `bson:"key,omitempty" json:"-"`
+}
+
+// Template is a named message template stored on a group. Each field is a Go
+// text/template source; empty fields keep the pushed value.
+type Template struct {
+	Author  string `bson:"author,omitempty" json:"author,omitempty"`
+	Title   string `bson:"title,omitempty" json:"title,omitempty"`
+	Content string `bson:"content,omitempty" json:"content,omitempty"`
+}
+
+// Format describes how deliveries to a session are encoded. Type is "json"
+// (the default payload), "template" (Body rendered as JSON), "form" (Fields
+// rendered and form encoded) or "text" (Body rendered as plain text).
+type Format struct {
+	Type    string            `bson:"type,omitempty" json:"type,omitempty"`
+	Body    string            `bson:"body,omitempty" json:"body,omitempty"`
+	Fields  map[string]string `bson:"fields,omitempty" json:"fields,omitempty"`
+	Method  string            `bson:"method,omitempty" json:"method,omitempty"`
+	Headers map[string]string `bson:"headers,omitempty" json:"headers,omitempty"`
+}
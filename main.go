@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/turbitcat/tbcpusher/v2/api"
 	"github.com/turbitcat/tbcpusher/v2/config"
@@ -14,6 +15,19 @@ func fileExists(filename string) bool {
 	return err == nil
 }
 
+// duration parses a duration setting, keeping d if it is empty or invalid.
+func duration(name string, v string, d time.Duration) time.Duration {
+	if v == "" {
+		return d
+	}
+	t, err := time.ParseDuration(v)
+	if err != nil {
+		println(name + ": " + err.Error())
+		return d
+	}
+	return t
+}
+
 func main() {
 	cfg := config.New()
 	err := cfg.ReadAll(config.DefaultPath())
@@ -23,7 +37,7 @@ func main() {
 	if !fileExists("config.yml") {
 		cfg.WriteFile(config.DefaultPath())
 	}
-	fmt.Printf("config: %+v\n", cfg)
+	fmt.Printf("config: %+v\n", cfg.Redacted())
 	db, err := database.NewMongo(cfg.Mongo.AtlasURI, cfg.Mongo.Database)
 	if err != nil {
 		panic(err)
@@ -33,5 +47,58 @@ func main() {
 	server := api.NewServer(db)
 	server.SetAddr(cfg.Api.Address)
 	server.SetPrefix(cfg.Api.Prefix)
+	if d, err := time.ParseDuration(cfg.Api.RestoreWindow); err == nil {
+		server.SetRestoreWindow(d)
+	} else if cfg.Api.RestoreWindow != "" {
+		println("restore_window: " + err.Error())
+	}
+	server.SetPublicURL(cfg.Api.PublicURL)
+	server.SetVerifyHooks(cfg.Api.VerifyHooks)
+	server.SetAckSecret(cfg.Api.AckSecret)
+	server.SetWorkers(cfg.Scheduler.Workers)
+	server.SetTelegramAPI(cfg.Telegram.APIBase)
+	server.SetSMTP(api.SMTPConfig{
+		Host:     cfg.Smtp.Host,
+		Port:     cfg.Smtp.Port,
+		Username: cfg.Smtp.Username,
+		Password: cfg.Smtp.Password,
+		From:     cfg.Smtp.From,
+		StartTLS: cfg.Smtp.StartTLS,
+		TLS:      cfg.Smtp.TLS,
+	})
+	if err := server.SetOutboundPolicy(api.OutboundPolicy{
+		Schemes:      cfg.Outbound.Schemes,
+		AllowHosts:   cfg.Outbound.AllowHosts,
+		DenyHosts:    cfg.Outbound.DenyHosts,
+		AllowCIDRs:   cfg.Outbound.AllowCIDRs,
+		DenyCIDRs:    cfg.Outbound.DenyCIDRs,
+		AllowPrivate: cfg.Outbound.AllowPrivate,
+		MaxRedirects: cfg.Outbound.MaxRedirects,
+	}); err != nil {
+		panic(err)
+	}
+	def := api.DefaultClientConfig()
+	if err := server.SetClientConfig(api.ClientConfig{
+		ConnectTimeout:      duration("connect_timeout", cfg.Client.ConnectTimeout, def.ConnectTimeout),
+		Timeout:             duration("timeout", cfg.Client.Timeout, def.Timeout),
+		MaxIdleConns:        cfg.Client.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.Client.MaxIdleConnsPerHost,
+		IdleConnTimeout:     duration("idle_conn_timeout", cfg.Client.IdleConnTimeout, def.IdleConnTimeout),
+		Proxy:               cfg.Client.Proxy,
+		CAFile:              cfg.Client.CAFile,
+		CertFile:            cfg.Client.CertFile,
+		KeyFile:             cfg.Client.KeyFile,
+	}); err != nil {
+		panic(err)
+	}
+	breaker := api.DefaultBreaker()
+	if err := server.SetBreaker(api.Breaker{
+		Threshold:     cfg.Breaker.Threshold,
+		Mode:          cfg.Breaker.Mode,
+		ProbeInterval: duration("probe_interval", cfg.Breaker.ProbeInterval, breaker.ProbeInterval),
+		HideAfter:     duration("hide_after", cfg.Breaker.HideAfter, breaker.HideAfter),
+	}); err != nil {
+		panic(err)
+	}
 	fmt.Println(server.Serve())
 }
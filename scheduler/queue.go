@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// Prioritized is implemented by jobs that should start before others when
+// several are waiting for a worker. Higher priorities start first.
+type Prioritized interface {
+	Priority() int
+}
+
+func priorityOf(j Job) int {
+	if p, ok := j.(Prioritized); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+type queued struct {
+	job      Job
+	priority int
+	seq      int
+}
+
+type queuedHeap []queued
+
+func (h queuedHeap) Len() int { return len(h) }
+func (h queuedHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h queuedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *queuedHeap) Push(x any)   { *h = append(*h, x.(queued)) }
+func (h *queuedHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// jobQueue hands due jobs to a fixed number of workers, highest priority first.
+type jobQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items queuedHeap
+	seq   int
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *jobQueue) push(j Job) {
+	q.mu.Lock()
+	q.seq++
+	heap.Push(&q.items, queued{job: j, priority: priorityOf(j), seq: q.seq})
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *jobQueue) pop() Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.items.Len() == 0 {
+		q.cond.Wait()
+	}
+	return heap.Pop(&q.items).(queued).job
+}
+
+func (q *jobQueue) work() {
+	for {
+		q.pop().Run()
+	}
+}
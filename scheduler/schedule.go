@@ -15,3 +15,15 @@ func (s *OneTimeSchedule) Next(t time.Time) time.Time {
 	s.T = time.Time{}
 	return r
 }
+
+// IntervalSchedule fires every Every after the previous run.
+type IntervalSchedule struct {
+	Every time.Duration
+}
+
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	if s.Every <= 0 {
+		return time.Time{}
+	}
+	return t.Add(s.Every)
+}
@@ -29,16 +29,19 @@ type Scheduler struct {
 	runningMu sync.Mutex
 	location  *time.Location
 	logger    Logger
+	workers   int
+	queue     *jobQueue
 }
 
 func newScheduler() *Scheduler {
-	return &Scheduler{add: make(chan Entry), remove: make(chan Entry), stop: make(chan struct{})}
+	return &Scheduler{add: make(chan Entry), remove: make(chan Entry), stop: make(chan struct{}), queue: newJobQueue()}
 }
 
 func NewDefult() *Scheduler {
 	s := newScheduler()
 	s.logger = PrintlnLogger()
 	s.location = time.Local
+	s.workers = 8
 	return s
 }
 
@@ -49,6 +52,16 @@ func (s *Scheduler) SetLogger(l Logger) {
 	s.logger = l
 }
 
+// SetWorkers sets how many jobs may run at the same time. A job holds its
+// worker until it returns, so once blocked jobs take every worker, all other
+// due jobs wait; jobs should bound how long they run.
+func (s *Scheduler) SetWorkers(n int) {
+	if s.running {
+		panic("cannot set workers while running")
+	}
+	s.workers = n
+}
+
 func (s *Scheduler) SetEntries(entries EntryList) {
 	s.runningMu.Lock()
 	defer s.runningMu.Unlock()
@@ -58,7 +71,7 @@ func (s *Scheduler) SetEntries(entries EntryList) {
 	s.entries = entries
 }
 
-func (s *Scheduler) AddJob(job Job, schedule Schedule) {
+func (s *Scheduler) AddJob(job Job, schedule Schedule) Entry {
 	s.runningMu.Lock()
 	defer s.runningMu.Unlock()
 	entry := s.entries.NewEntry(job, schedule)
@@ -67,10 +80,11 @@ func (s *Scheduler) AddJob(job Job, schedule Schedule) {
 	} else {
 		s.addEntry(entry)
 	}
+	return entry
 }
 
-func (s *Scheduler) AddFunc(f func(), schedule Schedule) {
-	s.AddJob(FuncJob(f), schedule)
+func (s *Scheduler) AddFunc(f func(), schedule Schedule) Entry {
+	return s.AddJob(FuncJob(f), schedule)
 }
 
 func (s *Scheduler) Remove(entry Entry) {
@@ -121,6 +135,9 @@ func (s *Scheduler) Run() {
 	}
 	s.running = true
 	s.runningMu.Unlock()
+	for i := 0; i < s.workers; i++ {
+		go s.queue.work()
+	}
 	go s.run()
 }
 
@@ -142,18 +159,21 @@ func (s *Scheduler) run() {
 			case now = <-timer.C:
 				now = now.In(s.location)
 				s.logger.Info("wake", "now", now)
+				var due []Entry
 				for _, v := range s.entries.All() {
-					next := v.Next()
-					if !next.After(now) {
-						startJob(v)
-						n := v.Schedule().Next(now)
-						v.SetNext(n)
-						if n.IsZero() {
-							s.removeEntry(v)
-						}
-						s.logger.Info("jobRunning", "now", now, "next", n)
+					if !v.Next().IsZero() && !v.Next().After(now) {
+						due = append(due, v)
 					}
 				}
+				for _, v := range due {
+					s.queue.push(v.Job())
+					n := v.Schedule().Next(now)
+					v.SetNext(n)
+					if n.IsZero() {
+						s.removeEntry(v)
+					}
+					s.logger.Info("jobRunning", "now", now, "next", n)
+				}
 			case newEntry := <-s.add:
 				timer.Stop()
 				now = s.now()
@@ -177,9 +197,3 @@ func (s *Scheduler) run() {
 		}
 	}
 }
-
-func startJob(entry Entry) {
-	go func() {
-		entry.Job().Run()
-	}()
-}
@@ -2,6 +2,7 @@ package wsgo
 
 import (
 	"net/http"
+	"strings"
 )
 
 type handleLeaf struct {
@@ -23,7 +24,12 @@ type ServerMux struct {
 	notFound   *group
 }
 
+// hit matches a path against a pattern. A pattern ending in "/*" matches
+// every path below it.
 func (p *ServerMux) hit(s1 string, s2 string) bool {
+	if strings.HasSuffix(s1, "/*") {
+		return strings.HasPrefix(s2, s1[:len(s1)-1])
+	}
 	return s1 == s2
 }
 